@@ -3,17 +3,45 @@ package app_registry
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 
 	app_compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
 	"gorm.io/gorm"
 )
 
-var ErrAppNotValid = errors.New("app is not valid")
+var (
+	ErrAppNotValid       = errors.New("app is not valid")
+	ErrUnknownHealPolicy = errors.New("unknown heal policy")
+	// ErrRevisionChanged fails an update prepared against a revision the
+	// app is no longer at.
+	ErrRevisionChanged = errors.New("app revision changed")
+)
+
+// HealPolicy is what the reconciler does about an app drifting from its
+// registered state.
+type HealPolicy string
 
+const (
+	// HealNone only reports drift.
+	HealNone HealPolicy = "none"
+	// HealRestart creates missing containers and brings containers back to
+	// the desired state, running or stopped.
+	HealRestart HealPolicy = "restart"
+	// HealRecreate also recreates containers that no longer match their
+	// service.
+	HealRecreate HealPolicy = "recreate"
+)
+
+// App is a registered compose project. Stopped is the state the app is
+// meant to be in, set by the start and stop operations.
 type App struct {
-	Name          string `gorm:"unique;not null" json:"name"`
-	ComposeScript string `json:"script"`
-	ComposeHash   string `gorm:"unique;not null" json:"hash"`
+	Name          string     `gorm:"unique;not null" json:"name"`
+	ComposeScript string     `json:"script"`
+	ComposeHash   string     `gorm:"unique;not null" json:"hash"`
+	Revision      uint       `gorm:"not null;default:0" json:"revision"`
+	Stopped       bool       `gorm:"not null;default:false" json:"stopped"`
+	HealPolicy    HealPolicy `gorm:"not null;default:none" json:"healPolicy"`
+	Labels        Labels     `json:"labels"`
 	gorm.Model
 }
 
@@ -40,6 +68,10 @@ func NewApp(name string, script string) (*App, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = app_compose.ValidateProject(project)
+	if err != nil {
+		return nil, err
+	}
 	scriptPayload, err := json.Marshal(project)
 	if err != nil {
 		return nil, err
@@ -61,6 +93,65 @@ func NewApp(name string, script string) (*App, error) {
 	return app, nil
 }
 
-func (reg *AppRegistry) UpdateApp(id uint, newScript string) error {
-	return reg.db.Model(&App{}).Where("ID = ?", id).Update("compose_script", newScript).Error
+// UpdateApp replaces the compose script and hash of the app with the ones
+// of newApp and records them as a new revision. The app must still be at
+// revision, the one the update was prepared against, ErrRevisionChanged is
+// returned otherwise.
+func (reg *AppRegistry) UpdateApp(id uint, revision uint, newApp *App, info RevisionInfo) (*AppRevision, error) {
+	var rev *AppRevision
+	err := reg.db.Transaction(func(tx *gorm.DB) error {
+		app := new(App)
+		if err := tx.Where("ID = ?", id).First(app).Error; err != nil {
+			return err
+		}
+		if app.Revision != revision {
+			return fmt.Errorf("%w: prepared against revision %d, the app is at %d", ErrRevisionChanged, revision, app.Revision)
+		}
+		app.ComposeScript = newApp.ComposeScript
+		app.ComposeHash = newApp.ComposeHash
+
+		var err error
+		rev, err = newRevision(tx, app, info)
+		if err != nil {
+			return err
+		}
+		// guarded by the revision too, for a server updating it meanwhile
+		result := tx.Model(app).Where("revision = ?", revision).Updates(map[string]interface{}{
+			"compose_script": app.ComposeScript,
+			"compose_hash":   app.ComposeHash,
+			"revision":       rev.Number,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("%w: prepared against revision %d", ErrRevisionChanged, revision)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// SetStopped records whether the app is meant to be running.
+func (reg *AppRegistry) SetStopped(id uint, stopped bool) error {
+	return reg.db.Model(&App{}).Where("ID = ?", id).Update("stopped", stopped).Error
+}
+
+func (reg *AppRegistry) SetHealPolicy(id uint, policy HealPolicy) error {
+	switch policy {
+	case HealNone, HealRestart, HealRecreate:
+	default:
+		return fmt.Errorf("%w '%s'", ErrUnknownHealPolicy, policy)
+	}
+	result := reg.db.Model(&App{}).Where("ID = ?", id).Update("heal_policy", policy)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
 }
@@ -0,0 +1,90 @@
+package app_registry
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RegistryCredential is the login used to pull images from an image
+// registry, by host as it appears in image references ("docker.io",
+// "ghcr.io", "registry.local:5000"). The password is never served back,
+// and is stored encrypted once the registry has a secret key, see
+// SetSecretKey.
+type RegistryCredential struct {
+	Registry string `gorm:"unique;not null" json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"-"`
+	gorm.Model
+}
+
+// SetRegistryCredential adds the credential or replaces the one of the same
+// registry.
+func (reg *AppRegistry) SetRegistryCredential(cred *RegistryCredential) error {
+	stored := *cred
+	if reg.secrets != nil {
+		sealed, err := reg.secrets.seal(cred.Password)
+		if err != nil {
+			return err
+		}
+		stored.Password = sealed
+	}
+	err := reg.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "registry"}},
+		DoUpdates: clause.AssignmentColumns([]string{"username", "password", "updated_at", "deleted_at"}),
+	}).Create(&stored).Error
+	if err != nil {
+		return err
+	}
+	cred.Model = stored.Model
+	return nil
+}
+
+// ListRegistryCredentials lists the credentials without their passwords,
+// which are only decrypted by GetRegistryCredential to pull images: one
+// that cannot be decrypted does not keep the others from being listed.
+func (reg *AppRegistry) ListRegistryCredentials() ([]RegistryCredential, error) {
+	creds := []RegistryCredential{}
+	result := reg.db.Omit("password").Order("registry").Find(&creds)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return creds, nil
+}
+
+// GetRegistryCredential returns the credential of the registry with its
+// password decrypted.
+func (reg *AppRegistry) GetRegistryCredential(registry string) (*RegistryCredential, error) {
+	cred := new(RegistryCredential)
+	result := reg.db.Where("registry = ?", registry).First(cred)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if err := reg.openPassword(cred); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+func (reg *AppRegistry) openPassword(cred *RegistryCredential) error {
+	password, err := reg.secrets.open(cred.Password)
+	if err != nil {
+		return fmt.Errorf("password of registry '%s': %w", cred.Registry, err)
+	}
+	cred.Password = password
+	return nil
+}
+
+// RemoveRegistryCredential deletes the credential for good, so no copy of
+// the password stays behind.
+func (reg *AppRegistry) RemoveRegistryCredential(registry string) error {
+	result := reg.db.Unscoped().Where("registry = ?", registry).Delete(&RegistryCredential{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
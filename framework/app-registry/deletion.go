@@ -0,0 +1,86 @@
+package app_registry
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AppDeletion records an app being deleted and what was removed with it.
+// The app row itself is only soft deleted, so it can be restored with its
+// revision history, though removed volumes and images are gone for good.
+type AppDeletion struct {
+	AppID          uint       `gorm:"index;not null" json:"appId"`
+	App            string     `json:"app"`
+	Author         string     `json:"author"`
+	Message        string     `json:"message"`
+	RemovedVolumes bool       `json:"removedVolumes"`
+	RemovedImages  bool       `json:"removedImages"`
+	RestoredAt     *time.Time `json:"restoredAt,omitempty"`
+	gorm.Model
+}
+
+// DeleteApp soft deletes the app and records the deletion.
+func (reg *AppRegistry) DeleteApp(id uint, deletion AppDeletion) (*AppDeletion, error) {
+	err := reg.db.Transaction(func(tx *gorm.DB) error {
+		app := new(App)
+		if err := tx.Where("ID = ?", id).First(app).Error; err != nil {
+			return err
+		}
+		deletion.AppID = app.ID
+		deletion.App = app.Name
+		if err := tx.Create(&deletion).Error; err != nil {
+			return err
+		}
+		return tx.Delete(app).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &deletion, nil
+}
+
+func (reg *AppRegistry) ListDeletedApps() ([]App, error) {
+	apps := []App{}
+	result := reg.db.Unscoped().Where("deleted_at IS NOT NULL").Find(&apps)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return apps, nil
+}
+
+func (reg *AppRegistry) ListDeletions(appID uint) ([]AppDeletion, error) {
+	deletions := []AppDeletion{}
+	result := reg.db.Where("app_id = ?", appID).Order("id").Find(&deletions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return deletions, nil
+}
+
+// RestoreApp brings back a deleted app. Its containers were removed with
+// it, so it comes back stopped.
+func (reg *AppRegistry) RestoreApp(id uint) (*App, error) {
+	app := new(App)
+	err := reg.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("ID = ? AND deleted_at IS NOT NULL", id).First(app).Error; err != nil {
+			return err
+		}
+		err := tx.Unscoped().Model(app).Updates(map[string]interface{}{
+			"deleted_at": nil,
+			"stopped":    true,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&AppDeletion{}).
+			Where("app_id = ? AND restored_at IS NULL", id).
+			Update("restored_at", time.Now()).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	app.DeletedAt = gorm.DeletedAt{}
+	app.Stopped = true
+	return app, nil
+}
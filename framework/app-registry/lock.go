@@ -0,0 +1,180 @@
+package app_registry
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/beowulf20/docker-delta-update-server/framework/logging"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrAppLocked = errors.New("app is locked by another operation")
+	// ErrLockLost is reported to the holder of a lock whose lease could not
+	// be renewed: another server may hold the app now.
+	ErrLockLost = errors.New("app lock lease lost")
+)
+
+// AppLock is the lease an operation holds on an app while it runs. Holder
+// is the ID of the job, Owner the update server running it.
+type AppLock struct {
+	AppID     uint      `gorm:"primaryKey;autoIncrement:false" json:"appId"`
+	Holder    string    `gorm:"not null" json:"holder"`
+	Operation string    `json:"operation"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type LockHeldError struct {
+	Lock AppLock
+}
+
+func (e *LockHeldError) Error() string {
+	return fmt.Sprintf("%s: %s %s", ErrAppLocked, e.Lock.Operation, e.Lock.Holder)
+}
+
+func (e *LockHeldError) Unwrap() error {
+	return ErrAppLocked
+}
+
+// AppLocker serializes operations on an app. Locks are always kept in
+// process; when the registry is shared between servers they are also
+// stored in the database as leases, renewed while held, so a crashed server
+// cannot keep an app locked past the lease.
+type AppLocker struct {
+	reg   *AppRegistry
+	lease time.Duration
+	owner string
+
+	mu   sync.Mutex
+	held map[uint]*heldLock
+}
+
+type heldLock struct {
+	lock AppLock
+	stop chan struct{}
+	lost func(err error)
+}
+
+func NewAppLocker(reg *AppRegistry, lease time.Duration) *AppLocker {
+	host, _ := os.Hostname()
+	return &AppLocker{
+		reg:   reg,
+		lease: lease,
+		owner: fmt.Sprintf("%s/%d", host, os.Getpid()),
+		held:  map[uint]*heldLock{},
+	}
+}
+
+// Lock locks the app for holder. lost is called, once and from another
+// goroutine, if the lease of a shared lock cannot be renewed: the holder
+// must then stop working on the app.
+func (l *AppLocker) Lock(appID uint, holder string, operation string, lost func(err error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if h, ok := l.held[appID]; ok {
+		return &LockHeldError{Lock: h.lock}
+	}
+
+	lock := AppLock{
+		AppID:     appID,
+		Holder:    holder,
+		Operation: operation,
+		Owner:     l.owner,
+		ExpiresAt: time.Now().Add(l.lease),
+	}
+	h := &heldLock{lock: lock, lost: lost}
+	if l.reg.shared {
+		if err := l.reg.acquireLock(lock); err != nil {
+			return err
+		}
+		h.stop = make(chan struct{})
+		go l.renew(h)
+	}
+	l.held[appID] = h
+	return nil
+}
+
+func (l *AppLocker) Unlock(appID uint, holder string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.held[appID]
+	if !ok || h.lock.Holder != holder {
+		return
+	}
+	delete(l.held, appID)
+	if h.stop != nil {
+		close(h.stop)
+		// left behind, the lease keeps the app locked until it expires
+		err := l.reg.db.Where("app_id = ? AND holder = ?", appID, holder).Delete(&AppLock{}).Error
+		if err != nil {
+			logging.Errorf("releasing the lock of app %d held by %s: %s", appID, holder, err)
+		}
+	}
+}
+
+// renew extends the lease of h until it is unlocked. A lease that is gone,
+// taken over by another server after it expired, or that failed to be
+// renewed until it is about to expire is lost.
+func (l *AppLocker) renew(h *heldLock) {
+	ticker := time.NewTicker(l.lease / 3)
+	defer ticker.Stop()
+	expires := h.lock.ExpiresAt
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			next := time.Now().Add(l.lease)
+			result := l.reg.db.Model(&AppLock{}).
+				Where("app_id = ? AND holder = ?", h.lock.AppID, h.lock.Holder).
+				Update("expires_at", next)
+			var err error
+			switch {
+			case result.Error == nil && result.RowsAffected == 0:
+				err = fmt.Errorf("%w: the lease of %s on app %d is gone", ErrLockLost, h.lock.Holder, h.lock.AppID)
+			case result.Error == nil:
+				expires = next
+				continue
+			case time.Now().Add(l.lease / 3).Before(expires):
+				// another try before the lease expires
+				logging.Warnf("renewing the lock of app %d held by %s: %s", h.lock.AppID, h.lock.Holder, result.Error)
+				continue
+			default:
+				err = fmt.Errorf("%w: renewing the lease of %s on app %d: %s", ErrLockLost, h.lock.Holder, h.lock.AppID, result.Error)
+			}
+			logging.Errorf("%s", err)
+			if h.lost != nil {
+				h.lost(err)
+			}
+			return
+		}
+	}
+}
+
+func (reg *AppRegistry) acquireLock(lock AppLock) error {
+	return reg.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("app_id = ? AND expires_at < ?", lock.AppID, time.Now()).Delete(&AppLock{}).Error
+		if err != nil {
+			return err
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&lock)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			return nil
+		}
+		current := AppLock{}
+		if err := tx.Where("app_id = ?", lock.AppID).First(&current).Error; err != nil {
+			return err
+		}
+		return &LockHeldError{Lock: current}
+	})
+}
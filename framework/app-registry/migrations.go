@@ -0,0 +1,283 @@
+package app_registry
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrSchemaTooNew = errors.New("registry schema is newer than this binary")
+
+// SchemaMigration records every migration applied to the registry database.
+type SchemaMigration struct {
+	Version   uint `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+type migration struct {
+	version uint
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// Migrations describe the schema as it was when they were written, so they
+// keep their own copies of the models instead of using the current ones.
+// Append new migrations at the end, never edit an applied one.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create apps",
+		up: func(tx *gorm.DB) error {
+			type App struct {
+				Name          string `gorm:"unique;not null"`
+				ComposeScript string
+				ComposeHash   string `gorm:"unique;not null"`
+				gorm.Model
+			}
+			return tx.AutoMigrate(&App{})
+		},
+	},
+	{
+		version: 2,
+		name:    "add app revisions",
+		up: func(tx *gorm.DB) error {
+			type App struct {
+				Name          string `gorm:"unique;not null"`
+				ComposeScript string
+				ComposeHash   string `gorm:"unique;not null"`
+				Revision      uint   `gorm:"not null;default:0"`
+				gorm.Model
+			}
+			type AppRevision struct {
+				AppID         uint `gorm:"uniqueIndex:idx_app_revision;not null"`
+				Number        uint `gorm:"uniqueIndex:idx_app_revision;not null"`
+				ComposeScript string
+				ComposeHash   string `gorm:"not null"`
+				Author        string
+				Message       string
+				gorm.Model
+			}
+			if err := tx.AutoMigrate(&App{}, &AppRevision{}); err != nil {
+				return err
+			}
+
+			// apps registered before revisions existed get their current
+			// script as revision 1
+			var apps []App
+			if err := tx.Unscoped().Find(&apps).Error; err != nil {
+				return err
+			}
+			for _, app := range apps {
+				err := tx.Create(&AppRevision{
+					AppID:         app.ID,
+					Number:        1,
+					ComposeScript: app.ComposeScript,
+					ComposeHash:   app.ComposeHash,
+					Message:       "imported",
+				}).Error
+				if err != nil {
+					return err
+				}
+				err = tx.Unscoped().Model(&app).Update("revision", 1).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 3,
+		name:    "add app locks",
+		up: func(tx *gorm.DB) error {
+			type AppLock struct {
+				AppID     uint   `gorm:"primaryKey;autoIncrement:false"`
+				Holder    string `gorm:"not null"`
+				Operation string
+				Owner     string
+				ExpiresAt time.Time
+			}
+			return tx.AutoMigrate(&AppLock{})
+		},
+	},
+	{
+		version: 4,
+		name:    "flag rolled back revisions",
+		up: func(tx *gorm.DB) error {
+			type AppRevision struct {
+				RolledBack bool `gorm:"not null;default:false"`
+			}
+			return tx.Migrator().AddColumn(&AppRevision{}, "RolledBack")
+		},
+	},
+	{
+		version: 5,
+		name:    "add app desired state and heal policy",
+		up: func(tx *gorm.DB) error {
+			type App struct {
+				Stopped    bool   `gorm:"not null;default:false"`
+				HealPolicy string `gorm:"not null;default:none"`
+			}
+			if err := tx.Migrator().AddColumn(&App{}, "Stopped"); err != nil {
+				return err
+			}
+			return tx.Migrator().AddColumn(&App{}, "HealPolicy")
+		},
+	},
+	{
+		version: 6,
+		name:    "record app deletions",
+		up: func(tx *gorm.DB) error {
+			type AppDeletion struct {
+				AppID          uint `gorm:"index;not null"`
+				App            string
+				Author         string
+				Message        string
+				RemovedVolumes bool
+				RemovedImages  bool
+				RestoredAt     *time.Time
+				gorm.Model
+			}
+			return tx.AutoMigrate(&AppDeletion{})
+		},
+	},
+	{
+		version: 7,
+		name:    "add registry credentials",
+		up: func(tx *gorm.DB) error {
+			type RegistryCredential struct {
+				Registry string `gorm:"unique;not null"`
+				Username string
+				Password string
+				gorm.Model
+			}
+			return tx.AutoMigrate(&RegistryCredential{})
+		},
+	},
+	{
+		version: 8,
+		name:    "record revision signing keys",
+		up: func(tx *gorm.DB) error {
+			type AppRevision struct {
+				SignedBy string
+			}
+			return tx.Migrator().AddColumn(&AppRevision{}, "SignedBy")
+		},
+	},
+	{
+		version: 9,
+		name:    "add api tokens",
+		up: func(tx *gorm.DB) error {
+			type ApiToken struct {
+				Name       string `gorm:"not null"`
+				Hash       string `gorm:"unique;not null"`
+				Scope      string `gorm:"not null"`
+				Apps       string
+				LastUsedAt *time.Time
+				gorm.Model
+			}
+			return tx.AutoMigrate(&ApiToken{})
+		},
+	},
+	{
+		version: 10,
+		name:    "add users, roles and role bindings",
+		up: func(tx *gorm.DB) error {
+			type App struct {
+				Labels string
+			}
+			type ApiToken struct {
+				UserID *uint `gorm:"index"`
+			}
+			type User struct {
+				Name string `gorm:"unique;not null"`
+				gorm.Model
+			}
+			type Role struct {
+				Name        string `gorm:"unique;not null"`
+				Permissions string
+				gorm.Model
+			}
+			type RoleBinding struct {
+				UserID   uint `gorm:"index;not null"`
+				RoleID   uint `gorm:"not null"`
+				Apps     string
+				Selector string
+				gorm.Model
+			}
+			if err := tx.Migrator().AddColumn(&App{}, "Labels"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().AddColumn(&ApiToken{}, "UserID"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&ApiToken{}, "UserID"); err != nil {
+				return err
+			}
+			if err := tx.AutoMigrate(&User{}, &Role{}, &RoleBinding{}); err != nil {
+				return err
+			}
+			// built-in roles to start from, free to change
+			return tx.Create([]Role{
+				{Name: "viewer", Permissions: "apps.read"},
+				{Name: "developer", Permissions: "apps.read,apps.start,apps.stop"},
+				{Name: "lead", Permissions: "apps.configure,apps.create,apps.delete,apps.read,apps.start,apps.stop,apps.update"},
+				{Name: "admin", Permissions: "*"},
+			}).Error
+		},
+	},
+}
+
+func latestSchemaVersion() uint {
+	return migrations[len(migrations)-1].version
+}
+
+func schemaVersion(db *gorm.DB) (uint, error) {
+	var version uint
+	err := db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+func migrate(db *gorm.DB) error {
+	return migrateTo(db, latestSchemaVersion())
+}
+
+// migrateTo applies the migrations up to version target, which the tests
+// use to start from the schema of an older release.
+func migrateTo(db *gorm.DB, target uint) error {
+	err := db.AutoMigrate(&SchemaMigration{})
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > latestSchemaVersion() {
+		return fmt.Errorf("%w: database is at version %d, binary knows up to %d", ErrSchemaTooNew, current, latestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   m.version,
+				Name:      m.name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
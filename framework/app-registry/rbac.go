@@ -0,0 +1,424 @@
+package app_registry
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrBadSelector       = errors.New("invalid label selector")
+)
+
+// Permission is an action of the API. Users get permissions through roles
+// bound to them, on every app or on some apps only.
+type Permission string
+
+const (
+	PermAppsRead      Permission = "apps.read"
+	PermAppsCreate    Permission = "apps.create"
+	PermAppsStart     Permission = "apps.start"
+	PermAppsStop      Permission = "apps.stop"
+	PermAppsUpdate    Permission = "apps.update"
+	PermAppsConfigure Permission = "apps.configure"
+	PermAppsDelete    Permission = "apps.delete"
+	// the permissions below do not belong to an app, only bindings on
+	// every app grant them
+	PermImagesRead       Permission = "images.read"
+	PermImagesPull       Permission = "images.pull"
+	PermRegistriesManage Permission = "registries.manage"
+	// PermAccessManage manages tokens, users, roles, bindings and app labels.
+	PermAccessManage Permission = "access.manage"
+	// PermAll is every permission, for roles only.
+	PermAll Permission = "*"
+)
+
+// permissionScopes are the least token scope able to use each permission,
+// so a token never does more than its scope, whatever its user may do.
+var permissionScopes = map[Permission]TokenScope{
+	PermAppsRead:         ScopeRead,
+	PermAppsCreate:       ScopeDeploy,
+	PermAppsStart:        ScopeDeploy,
+	PermAppsStop:         ScopeDeploy,
+	PermAppsUpdate:       ScopeDeploy,
+	PermAppsConfigure:    ScopeDeploy,
+	PermAppsDelete:       ScopeAdmin,
+	PermImagesRead:       ScopeRead,
+	PermImagesPull:       ScopeDeploy,
+	PermRegistriesManage: ScopeAdmin,
+	PermAccessManage:     ScopeAdmin,
+}
+
+func (p Permission) Scope() TokenScope {
+	return permissionScopes[p]
+}
+
+// NameList is a list of names stored comma separated. App names, role
+// names and permissions cannot hold commas.
+type NameList []string
+
+func (l NameList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *NameList) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a name list", value)
+	}
+	*l = NameList{}
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+func (l NameList) Has(name string) bool {
+	for _, n := range l {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Labels are the labels of an app, stored as JSON. They only serve to
+// select apps in role bindings.
+type Labels map[string]string
+
+func (l Labels) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+func (l *Labels) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("cannot scan %T into labels", value)
+	}
+	*l = Labels{}
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, l)
+}
+
+type Role struct {
+	Name        string   `gorm:"unique;not null" json:"name"`
+	Permissions NameList `json:"permissions"`
+	gorm.Model
+}
+
+func (r *Role) Allows(perm Permission) bool {
+	return r.Permissions.Has(string(PermAll)) || r.Permissions.Has(string(perm))
+}
+
+type User struct {
+	Name string `gorm:"unique;not null" json:"name"`
+	gorm.Model
+}
+
+// RoleBinding gives the permissions of a role to a user, on the apps named
+// in Apps and matching Selector. A binding with neither is on every app,
+// and only such a binding grants the permissions not tied to an app.
+type RoleBinding struct {
+	UserID   uint     `gorm:"index;not null" json:"userId"`
+	User     User     `json:"user"`
+	RoleID   uint     `gorm:"not null" json:"roleId"`
+	Role     Role     `json:"role"`
+	Apps     NameList `json:"apps"`
+	Selector string   `json:"selector"`
+	gorm.Model
+}
+
+func (b *RoleBinding) global() bool {
+	return len(b.Apps) == 0 && b.Selector == ""
+}
+
+func (b *RoleBinding) matches(app *App) bool {
+	if len(b.Apps) > 0 && !b.Apps.Has(app.Name) {
+		return false
+	}
+	if b.Selector == "" {
+		return true
+	}
+	sel, err := ParseSelector(b.Selector)
+	return err == nil && sel.Matches(app.Labels)
+}
+
+// Selector picks apps by their labels: comma separated requirements, each
+// "key=value", "key!=value" or a bare "key" that must exist.
+type Selector []requirement
+
+type requirement struct {
+	key   string
+	op    string
+	value string
+}
+
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		req := requirement{op: "exists"}
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			req = requirement{key: strings.TrimSpace(kv[0]), op: "!=", value: strings.TrimSpace(kv[1])}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			req = requirement{key: strings.TrimSpace(kv[0]), op: "=", value: strings.TrimSpace(kv[1])}
+		default:
+			req.key = part
+		}
+		if req.key == "" {
+			return nil, fmt.Errorf("%w: '%s'", ErrBadSelector, s)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+func (sel Selector) Matches(labels Labels) bool {
+	for _, req := range sel {
+		value, ok := labels[req.key]
+		switch req.op {
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "=":
+			if !ok || value != req.value {
+				return false
+			}
+		case "!=":
+			if ok && value == req.value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Grants are what a user may do through its role bindings.
+type Grants struct {
+	User     User          `json:"user"`
+	Bindings []RoleBinding `json:"bindings"`
+}
+
+// Allows tells whether the user has the permission on the app, or, for a
+// nil app, on everything.
+func (g *Grants) Allows(perm Permission, app *App) bool {
+	for i := range g.Bindings {
+		b := &g.Bindings[i]
+		if !b.Role.Allows(perm) {
+			continue
+		}
+		if b.global() || (app != nil && b.matches(app)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (reg *AppRegistry) UserGrants(userID uint) (*Grants, error) {
+	grants := new(Grants)
+	if err := reg.db.First(&grants.User, userID).Error; err != nil {
+		return nil, err
+	}
+	err := reg.db.Preload("Role").Where("user_id = ?", userID).Order("id").Find(&grants.Bindings).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range grants.Bindings {
+		grants.Bindings[i].User = grants.User
+	}
+	return grants, nil
+}
+
+func (reg *AppRegistry) CreateUser(name string) (*User, error) {
+	if err := validateStringSpecialCharacters(name); err != nil {
+		return nil, fmt.Errorf("user name: %w", err)
+	}
+	user := &User{Name: name}
+	err := reg.db.Where("name = ?", name).First(new(User)).Error
+	switch {
+	case err == nil:
+		return nil, fmt.Errorf("user '%s' %w", name, ErrAlreadyExists)
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	}
+	if err := reg.db.Create(user).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (reg *AppRegistry) ListUsers() ([]User, error) {
+	users := []User{}
+	result := reg.db.Order("name").Find(&users)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return users, nil
+}
+
+func (reg *AppRegistry) GetUserByName(name string) (*User, error) {
+	user := new(User)
+	result := reg.db.Where("name = ?", name).First(user)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return user, nil
+}
+
+// RemoveUser deletes the user with its bindings and revokes its tokens.
+func (reg *AppRegistry) RemoveUser(id uint) error {
+	return reg.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Delete(&User{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Unscoped().Where("user_id = ?", id).Delete(&RoleBinding{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", id).Delete(&ApiToken{}).Error
+	})
+}
+
+// SetRole creates the role or replaces its permissions.
+func (reg *AppRegistry) SetRole(name string, perms []Permission) (*Role, error) {
+	if err := validateStringSpecialCharacters(name); err != nil {
+		return nil, fmt.Errorf("role name: %w", err)
+	}
+	names := NameList{}
+	for _, perm := range perms {
+		if perm != PermAll && perm.Scope() == "" {
+			return nil, fmt.Errorf("%w: '%s'", ErrUnknownPermission, perm)
+		}
+		names = append(names, string(perm))
+	}
+	sort.Strings(names)
+
+	role := new(Role)
+	err := reg.db.Where("name = ?", name).First(role).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		role = &Role{Name: name, Permissions: names}
+		err = reg.db.Create(role).Error
+	case err == nil:
+		role.Permissions = names
+		err = reg.db.Model(role).Update("permissions", names).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+func (reg *AppRegistry) ListRoles() ([]Role, error) {
+	roles := []Role{}
+	result := reg.db.Order("name").Find(&roles)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return roles, nil
+}
+
+// RemoveRole deletes the role with the bindings to it.
+func (reg *AppRegistry) RemoveRole(name string) error {
+	return reg.db.Transaction(func(tx *gorm.DB) error {
+		role := new(Role)
+		if err := tx.Where("name = ?", name).First(role).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("role_id = ?", role.ID).Delete(&RoleBinding{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(role).Error
+	})
+}
+
+// BindRole gives the role to the user on the apps named and matching the
+// selector, on every app when both are empty.
+func (reg *AppRegistry) BindRole(userName string, roleName string, apps []string, selector string) (*RoleBinding, error) {
+	for _, app := range apps {
+		if err := validateStringSpecialCharacters(app); err != nil {
+			return nil, fmt.Errorf("app '%s': %w", app, err)
+		}
+	}
+	if selector != "" {
+		if _, err := ParseSelector(selector); err != nil {
+			return nil, err
+		}
+	}
+	binding := &RoleBinding{Apps: NameList(apps), Selector: selector}
+	if err := reg.db.Where("name = ?", userName).First(&binding.User).Error; err != nil {
+		return nil, fmt.Errorf("user '%s': %w", userName, err)
+	}
+	if err := reg.db.Where("name = ?", roleName).First(&binding.Role).Error; err != nil {
+		return nil, fmt.Errorf("role '%s': %w", roleName, err)
+	}
+	binding.UserID = binding.User.ID
+	binding.RoleID = binding.Role.ID
+	if err := reg.db.Omit("User", "Role").Create(binding).Error; err != nil {
+		return nil, err
+	}
+	return binding, nil
+}
+
+func (reg *AppRegistry) ListBindings() ([]RoleBinding, error) {
+	bindings := []RoleBinding{}
+	result := reg.db.Preload("User").Preload("Role").Order("id").Find(&bindings)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return bindings, nil
+}
+
+func (reg *AppRegistry) RemoveBinding(id uint) error {
+	result := reg.db.Unscoped().Delete(&RoleBinding{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// SetAppLabels replaces the labels of the app.
+func (reg *AppRegistry) SetAppLabels(id uint, labels Labels) error {
+	result := reg.db.Model(&App{}).Where("ID = ?", id).Update("labels", labels)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
@@ -1,29 +1,89 @@
 package app_registry
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 type AppRegistry struct {
 	db *gorm.DB
+	// shared is set when other update servers may use the same database
+	shared bool
+	// secrets encrypts the stored secrets once SetSecretKey is called
+	secrets *secretBox
+}
+
+func openDialector(driver string, dsn string) (gorm.Dialector, error) {
+	switch driver {
+	case DriverSQLite:
+		if dsn != ":memory:" {
+			err := os.MkdirAll(filepath.Dir(dsn), 0755)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return sqlite.Open(dsn), nil
+	case DriverMySQL:
+		cfg, err := gomysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		// gorm.Model timestamps need to be scanned as time.Time
+		cfg.ParseTime = true
+		return mysql.Open(cfg.FormatDSN()), nil
+	default:
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownDriver, driver)
+	}
+}
+
+const (
+	DriverSQLite = "sqlite"
+	DriverMySQL  = "mysql"
+)
+
+var (
+	ErrUnknownDriver = errors.New("unknown registry driver")
+	ErrAlreadyExists = errors.New("already exists")
+)
+
+// NewAppRegistry opens the registry database and brings its schema up to
+// date. For DriverSQLite the dsn is a file path, its directory is created if
+// needed, and ":memory:" gives a registry that does not survive restarts.
+// For DriverMySQL the dsn is a go-sql-driver DSN, which lets several update
+// servers share one registry.
+func NewAppRegistry(driver string, dsn string) (*AppRegistry, error) {
+	return NewAppRegistryWithLogger(driver, dsn, logger.Default)
 }
 
-func NewAppRegistry() (*AppRegistry, error) {
-	// db, err := gorm.Open(sqlite.Open("app_reg.db"), &gorm.Config{})
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+// NewAppRegistryWithLogger is NewAppRegistry logging the database queries
+// with l.
+func NewAppRegistryWithLogger(driver string, dsn string, l logger.Interface) (*AppRegistry, error) {
+	dialector, err := openDialector(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
 
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: l})
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&App{})
+	err = migrate(db)
 	if err != nil {
 		return nil, err
 	}
 
 	return &AppRegistry{
-		db: db,
+		db:     db,
+		shared: driver == DriverMySQL,
 	}, nil
 }
 
@@ -36,8 +96,29 @@ func (reg *AppRegistry) ListApps() ([]App, error) {
 	return apps, nil
 }
 
-func (reg *AppRegistry) AddApp(app *App) error {
-	return reg.db.Create(app).Error
+// AddApp registers the app and records its compose script as revision 1.
+// The app is registered stopped, until it is started.
+func (reg *AppRegistry) AddApp(app *App, info RevisionInfo) error {
+	return reg.db.Transaction(func(tx *gorm.DB) error {
+		// a deleted app keeps its name until it is purged
+		existing := new(App)
+		err := tx.Unscoped().Where("name = ?", app.Name).First(existing).Error
+		switch {
+		case err == nil && existing.DeletedAt.Valid:
+			return fmt.Errorf("app '%s' %w as a deleted app, restore it instead", app.Name, ErrAlreadyExists)
+		case err == nil:
+			return fmt.Errorf("app '%s' %w", app.Name, ErrAlreadyExists)
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		}
+		app.Revision = 1
+		app.Stopped = true
+		if err := tx.Create(app).Error; err != nil {
+			return err
+		}
+		_, err = newRevision(tx, app, info)
+		return err
+	})
 }
 
 func (reg *AppRegistry) RemoveAppByID(id uint) error {
@@ -52,3 +133,12 @@ func (reg *AppRegistry) GetAppByID(id uint) (*App, error) {
 	}
 	return app, nil
 }
+
+func (reg *AppRegistry) GetAppByName(name string) (*App, error) {
+	app := new(App)
+	result := reg.db.Where("name = ?", name).First(app)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return app, nil
+}
@@ -0,0 +1,359 @@
+package app_registry
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// mysqlDSNEnv names a MySQL database to run the tests against as well as
+// sqlite. Every table in it is dropped.
+const mysqlDSNEnv = "DDU_TEST_MYSQL_DSN"
+
+type testDatabase struct {
+	driver string
+	dsn    string
+}
+
+func testDatabases(t *testing.T) []testDatabase {
+	databases := []testDatabase{{driver: DriverSQLite}}
+	if dsn := os.Getenv(mysqlDSNEnv); dsn != "" {
+		databases = append(databases, testDatabase{driver: DriverMySQL, dsn: dsn})
+	} else {
+		t.Logf("%s not set, skipping mysql", mysqlDSNEnv)
+	}
+	return databases
+}
+
+// openTestDB opens an empty database: a new sqlite file, or the MySQL
+// database with its tables dropped.
+func openTestDB(t *testing.T, database testDatabase) *gorm.DB {
+	t.Helper()
+	dsn := database.dsn
+	if database.driver == DriverSQLite {
+		// the lease renewal writes concurrently with the tests
+		dsn = filepath.Join(t.TempDir(), "registry.db") + "?_busy_timeout=5000"
+	}
+	dialector, err := openDialector(database.driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if database.driver == DriverMySQL {
+		var tables []string
+		if err := db.Raw("SHOW TABLES").Scan(&tables).Error; err != nil {
+			t.Fatal(err)
+		}
+		for _, table := range tables {
+			if err := db.Migrator().DropTable(table); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return db
+}
+
+func newTestRegistry(t *testing.T, database testDatabase) *AppRegistry {
+	t.Helper()
+	db := openTestDB(t, database)
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return &AppRegistry{db: db, shared: database.driver == DriverMySQL}
+}
+
+const testScript = `
+services:
+  web:
+    image: nginx
+`
+
+func TestMigrations(t *testing.T) {
+	latest := latestSchemaVersion()
+	for _, database := range testDatabases(t) {
+		for from := uint(0); from <= latest; from++ {
+			t.Run(fmt.Sprintf("%s from %d", database.driver, from), func(t *testing.T) {
+				db := openTestDB(t, database)
+				if err := migrateTo(db, from); err != nil {
+					t.Fatalf("migrating to %d: %s", from, err)
+				}
+				if from == 1 {
+					// an app registered before revisions existed
+					err := db.Exec("INSERT INTO apps (name, compose_script, compose_hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+						"legacy", testScript, "legacy-hash", time.Now(), time.Now()).Error
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if err := migrate(db); err != nil {
+					t.Fatalf("migrating from %d: %s", from, err)
+				}
+				// applying them again is a no-op
+				if err := migrate(db); err != nil {
+					t.Fatalf("migrating again: %s", err)
+				}
+
+				var applied []SchemaMigration
+				if err := db.Order("version").Find(&applied).Error; err != nil {
+					t.Fatal(err)
+				}
+				if uint(len(applied)) != latest {
+					t.Fatalf("%d migrations recorded, want %d", len(applied), latest)
+				}
+				for i, m := range applied {
+					if m.Version != migrations[i].version || m.Name != migrations[i].name {
+						t.Errorf("migration %d recorded as %d %q", migrations[i].version, m.Version, m.Name)
+					}
+				}
+
+				reg := &AppRegistry{db: db}
+				if from == 1 {
+					app, err := reg.GetAppByName("legacy")
+					if err != nil {
+						t.Fatal(err)
+					}
+					if app.Revision != 1 || app.HealPolicy != "none" || app.Stopped {
+						t.Errorf("legacy app = revision %d, heal policy %q, stopped %t", app.Revision, app.HealPolicy, app.Stopped)
+					}
+					rev, err := reg.GetRevision(app.ID, 1)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if rev.Message != "imported" || rev.ComposeHash != "legacy-hash" {
+						t.Errorf("legacy revision = %q %q", rev.Message, rev.ComposeHash)
+					}
+				}
+				var roles int64
+				if err := db.Model(&Role{}).Count(&roles).Error; err != nil {
+					t.Fatal(err)
+				}
+				if roles != 4 {
+					t.Errorf("%d built-in roles, want 4", roles)
+				}
+			})
+		}
+	}
+}
+
+func TestMigrationsSchemaTooNew(t *testing.T) {
+	for _, database := range testDatabases(t) {
+		t.Run(database.driver, func(t *testing.T) {
+			reg := newTestRegistry(t, database)
+			next := SchemaMigration{Version: latestSchemaVersion() + 1, Name: "from the future", AppliedAt: time.Now()}
+			if err := reg.db.Create(&next).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err := migrate(reg.db); !errors.Is(err, ErrSchemaTooNew) {
+				t.Fatalf("error = %v, want %v", err, ErrSchemaTooNew)
+			}
+		})
+	}
+}
+
+func TestRegistryTimestamps(t *testing.T) {
+	for _, database := range testDatabases(t) {
+		t.Run(database.driver, func(t *testing.T) {
+			reg := newTestRegistry(t, database)
+			before := time.Now().Add(-time.Minute)
+			app := &App{Name: "web", ComposeScript: testScript, ComposeHash: "hash"}
+			if err := reg.AddApp(app, RevisionInfo{Author: "test"}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := reg.GetAppByName("web")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.CreatedAt.Before(before) {
+				t.Errorf("created at %s, want after %s", got.CreatedAt, before)
+			}
+		})
+	}
+}
+
+func TestUpdateAppRevisionChanged(t *testing.T) {
+	for _, database := range testDatabases(t) {
+		t.Run(database.driver, func(t *testing.T) {
+			reg := newTestRegistry(t, database)
+			app := &App{Name: "web", ComposeScript: testScript, ComposeHash: "hash"}
+			if err := reg.AddApp(app, RevisionInfo{}); err != nil {
+				t.Fatal(err)
+			}
+			update := &App{ComposeScript: testScript + "    restart: always\n", ComposeHash: "hash2"}
+			rev, err := reg.UpdateApp(app.ID, 1, update, RevisionInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev.Number != 2 {
+				t.Fatalf("recorded revision %d, want 2", rev.Number)
+			}
+			// prepared against revision 1 too, before the first one landed
+			if _, err := reg.UpdateApp(app.ID, 1, update, RevisionInfo{}); !errors.Is(err, ErrRevisionChanged) {
+				t.Fatalf("stale update: %v, want %v", err, ErrRevisionChanged)
+			}
+			revs, err := reg.ListRevisions(app.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(revs) != 2 {
+				t.Errorf("%d revisions recorded, want 2", len(revs))
+			}
+		})
+	}
+}
+
+func TestOpenDialectorParseTime(t *testing.T) {
+	for _, dsn := range []string{
+		"user:secret@tcp(db:3306)/registry",
+		"user:secret@tcp(db:3306)/registry?parseTime=false",
+		"user:secret@tcp(db:3306)/registry?parseTime=true&charset=utf8mb4",
+	} {
+		t.Run(dsn, func(t *testing.T) {
+			dialector, err := openDialector(DriverMySQL, dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := dialector.(*mysql.Dialector).DSN
+			if !strings.Contains(got, "parseTime=true") {
+				t.Errorf("dsn %q does not parse time", got)
+			}
+			if !strings.HasPrefix(got, "user:secret@tcp(db:3306)/registry") {
+				t.Errorf("dsn %q does not keep the address", got)
+			}
+		})
+	}
+	if _, err := openDialector("postgres", ""); !errors.Is(err, ErrUnknownDriver) {
+		t.Errorf("error = %v, want %v", err, ErrUnknownDriver)
+	}
+}
+
+func TestAppLockerLease(t *testing.T) {
+	for _, database := range testDatabases(t) {
+		t.Run(database.driver, func(t *testing.T) {
+			reg := newTestRegistry(t, database)
+			// two servers sharing the database
+			reg.shared = true
+			lease := 300 * time.Millisecond
+			first := NewAppLocker(reg, lease)
+			second := NewAppLocker(reg, lease)
+			first.owner, second.owner = "first", "second"
+
+			if err := first.Lock(1, "job-a", "update", nil); err != nil {
+				t.Fatal(err)
+			}
+			var held *LockHeldError
+			err := first.Lock(1, "job-b", "start", nil)
+			if !errors.As(err, &held) || held.Lock.Holder != "job-a" {
+				t.Fatalf("locking again in process: %v", err)
+			}
+			err = second.Lock(1, "job-c", "start", nil)
+			if !errors.As(err, &held) || held.Lock.Holder != "job-a" || held.Lock.Owner != "first" {
+				t.Fatalf("locking from the other server: %v", err)
+			}
+			if !errors.Is(err, ErrAppLocked) {
+				t.Errorf("error = %v, want %v", err, ErrAppLocked)
+			}
+			if err := second.Lock(2, "job-d", "start", nil); err != nil {
+				t.Fatalf("locking another app: %s", err)
+			}
+			second.Unlock(2, "job-d")
+
+			// the lease is renewed while held
+			time.Sleep(3 * lease)
+			if err := second.Lock(1, "job-c", "start", nil); !errors.Is(err, ErrAppLocked) {
+				t.Fatalf("locking after the lease: %v", err)
+			}
+
+			// unlocking with another holder does nothing
+			first.Unlock(1, "job-b")
+			if err := second.Lock(1, "job-c", "start", nil); !errors.Is(err, ErrAppLocked) {
+				t.Fatalf("locking after a foreign unlock: %v", err)
+			}
+			first.Unlock(1, "job-a")
+			if err := second.Lock(1, "job-c", "start", nil); err != nil {
+				t.Fatalf("locking after unlock: %s", err)
+			}
+			second.Unlock(1, "job-c")
+		})
+	}
+}
+
+func TestAppLockerLostLease(t *testing.T) {
+	for _, database := range testDatabases(t) {
+		t.Run(database.driver, func(t *testing.T) {
+			reg := newTestRegistry(t, database)
+			reg.shared = true
+			locker := NewAppLocker(reg, 300*time.Millisecond)
+			lost := make(chan error, 1)
+			if err := locker.Lock(1, "job-a", "update", func(err error) { lost <- err }); err != nil {
+				t.Fatal(err)
+			}
+			defer locker.Unlock(1, "job-a")
+
+			// another server took the lease over after it expired
+			err := reg.db.Model(&AppLock{}).Where("app_id = ?", 1).Update("holder", "job-b").Error
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-lost:
+				if !errors.Is(err, ErrLockLost) {
+					t.Errorf("lost with %v, want %v", err, ErrLockLost)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the lost lease was not reported")
+			}
+		})
+	}
+}
+
+func TestAppLockerExpiredLease(t *testing.T) {
+	for _, database := range testDatabases(t) {
+		t.Run(database.driver, func(t *testing.T) {
+			reg := newTestRegistry(t, database)
+			reg.shared = true
+			// left behind by a server that crashed
+			crashed := AppLock{AppID: 1, Holder: "job-a", Operation: "update", Owner: "crashed", ExpiresAt: time.Now().Add(-time.Second)}
+			if err := reg.db.Create(&crashed).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			locker := NewAppLocker(reg, time.Minute)
+			if err := locker.Lock(1, "job-b", "start", nil); err != nil {
+				t.Fatalf("locking past the lease: %s", err)
+			}
+			current := AppLock{}
+			if err := reg.db.Where("app_id = ?", 1).First(&current).Error; err != nil {
+				t.Fatal(err)
+			}
+			if current.Holder != "job-b" || !current.ExpiresAt.After(time.Now()) {
+				t.Errorf("lock = %+v", current)
+			}
+			locker.Unlock(1, "job-b")
+			var count int64
+			if err := reg.db.Model(&AppLock{}).Count(&count).Error; err != nil {
+				t.Fatal(err)
+			}
+			if count != 0 {
+				t.Errorf("%d leases left after unlock", count)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package app_registry
+
+import (
+	"gorm.io/gorm"
+)
+
+// AppRevision is an immutable copy of a compose script an app was registered
+// or updated with. Revisions are numbered from 1 for each app.
+type AppRevision struct {
+	AppID         uint   `gorm:"uniqueIndex:idx_app_revision;not null" json:"appId"`
+	Number        uint   `gorm:"uniqueIndex:idx_app_revision;not null" json:"number"`
+	ComposeScript string `json:"script"`
+	ComposeHash   string `gorm:"not null" json:"hash"`
+	Author        string `json:"author"`
+	Message       string `json:"message"`
+	RolledBack    bool   `gorm:"not null;default:false" json:"rolledBack"`
+	// SignedBy is the id of the trusted key the compose script was signed
+	// with, empty when signatures are not required.
+	SignedBy string `json:"signedBy,omitempty"`
+	gorm.Model
+}
+
+type RevisionInfo struct {
+	Author   string
+	Message  string
+	SignedBy string
+}
+
+func newRevision(tx *gorm.DB, app *App, info RevisionInfo) (*AppRevision, error) {
+	var last uint
+	err := tx.Model(&AppRevision{}).Where("app_id = ?", app.ID).Select("COALESCE(MAX(number), 0)").Scan(&last).Error
+	if err != nil {
+		return nil, err
+	}
+	rev := &AppRevision{
+		AppID:         app.ID,
+		Number:        last + 1,
+		ComposeScript: app.ComposeScript,
+		ComposeHash:   app.ComposeHash,
+		Author:        info.Author,
+		Message:       info.Message,
+		SignedBy:      info.SignedBy,
+	}
+	err = tx.Create(rev).Error
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+func (reg *AppRegistry) ListRevisions(appID uint) ([]AppRevision, error) {
+	revs := []AppRevision{}
+	result := reg.db.Where("app_id = ?", appID).Order("number").Find(&revs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return revs, nil
+}
+
+func (reg *AppRegistry) GetRevision(appID uint, number uint) (*AppRevision, error) {
+	rev := new(AppRevision)
+	result := reg.db.Where("app_id = ? AND number = ?", appID, number).First(rev)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return rev, nil
+}
+
+// MarkRevisionRolledBack flags a revision whose deployment was undone.
+func (reg *AppRegistry) MarkRevisionRolledBack(appID uint, number uint) error {
+	return reg.db.Model(&AppRevision{}).Where("app_id = ? AND number = ?", appID, number).Update("rolled_back", true).Error
+}
@@ -0,0 +1,148 @@
+package app_registry
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+var ErrSecretKey = errors.New("cannot decrypt registry secret")
+
+// SecretKeySize is the size of the AES-256 key secrets are encrypted with.
+const SecretKeySize = 32
+
+// Encrypted secrets are stored as secretPrefix, the id of the key, ":" and
+// the base64 of the GCM nonce followed by the sealed secret. A value without
+// the prefix was stored in plaintext before a key was set.
+const secretPrefix = "enc:v1:"
+
+// secretBox seals the secrets the registry keeps, registry passwords, with
+// a key that lives outside the database: a copy of a shared database alone
+// does not give them away.
+type secretBox struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newSecretBox(key []byte) (*secretBox, error) {
+	if len(key) != SecretKeySize {
+		return nil, fmt.Errorf("secret key must be %d bytes, not %d", SecretKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &secretBox{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+func (b *secretBox) seal(secret string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(secret), nil)
+	return secretPrefix + b.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open returns the secret of a stored value, which may be plaintext.
+func (b *secretBox) open(stored string) (string, error) {
+	if !strings.HasPrefix(stored, secretPrefix) {
+		return stored, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(stored, secretPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("%w: malformed value", ErrSecretKey)
+	}
+	if b == nil {
+		return "", fmt.Errorf("%w: encrypted with key %s, no key is set", ErrSecretKey, parts[0])
+	}
+	if parts[0] != b.id {
+		return "", fmt.Errorf("%w: encrypted with key %s, the key set is %s", ErrSecretKey, parts[0], b.id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < b.aead.NonceSize() {
+		return "", fmt.Errorf("%w: malformed value", ErrSecretKey)
+	}
+	nonce, sealed := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	secret, err := b.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrSecretKey, err)
+	}
+	return string(secret), nil
+}
+
+// SetSecretKey encrypts the secrets stored from now on with key, and the
+// ones stored in plaintext so far. Without a key they are stored in
+// plaintext, readable by anyone with a copy of the database.
+func (reg *AppRegistry) SetSecretKey(key []byte) error {
+	box, err := newSecretBox(key)
+	if err != nil {
+		return err
+	}
+	err = reg.db.Transaction(func(tx *gorm.DB) error {
+		var creds []RegistryCredential
+		if err := tx.Where("password NOT LIKE ?", secretPrefix+"%").Find(&creds).Error; err != nil {
+			return err
+		}
+		for _, cred := range creds {
+			sealed, err := box.seal(cred.Password)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&cred).UpdateColumn("password", sealed).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	reg.secrets = box
+	return nil
+}
+
+// LoadSecretKey reads the base64 key of the file, creating the file with a
+// new key if it does not exist. Servers sharing a database must share the
+// key file too.
+func LoadSecretKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, SecretKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+		return key, ioutil.WriteFile(path, []byte(encoded), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(key) != SecretKeySize {
+		return nil, fmt.Errorf("%s: secret key must be %d bytes, not %d", path, SecretKeySize, len(key))
+	}
+	return key, nil
+}
@@ -0,0 +1,99 @@
+package app_registry
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistryCredentialEncryption(t *testing.T) {
+	for _, database := range testDatabases(t) {
+		t.Run(database.driver, func(t *testing.T) {
+			reg := newTestRegistry(t, database)
+			storedPassword := func(registry string) string {
+				t.Helper()
+				var password string
+				err := reg.db.Model(&RegistryCredential{}).Where("registry = ?", registry).Select("password").Scan(&password).Error
+				if err != nil {
+					t.Fatal(err)
+				}
+				return password
+			}
+
+			// stored before a key was set
+			if err := reg.SetRegistryCredential(&RegistryCredential{Registry: "old.io", Username: "u", Password: "old-secret"}); err != nil {
+				t.Fatal(err)
+			}
+			if storedPassword("old.io") != "old-secret" {
+				t.Fatal("password without a key is not stored as is")
+			}
+
+			key := bytes.Repeat([]byte{1}, SecretKeySize)
+			if err := reg.SetSecretKey(key); err != nil {
+				t.Fatal(err)
+			}
+			if err := reg.SetRegistryCredential(&RegistryCredential{Registry: "new.io", Username: "u", Password: "new-secret"}); err != nil {
+				t.Fatal(err)
+			}
+			for registry, secret := range map[string]string{"old.io": "old-secret", "new.io": "new-secret"} {
+				if stored := storedPassword(registry); !strings.HasPrefix(stored, secretPrefix) || strings.Contains(stored, secret) {
+					t.Errorf("password of %s stored as %q", registry, stored)
+				}
+				cred, err := reg.GetRegistryCredential(registry)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cred.Password != secret {
+					t.Errorf("password of %s = %q, want %q", registry, cred.Password, secret)
+				}
+			}
+			creds, err := reg.ListRegistryCredentials()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(creds) != 2 || creds[0].Registry != "new.io" || creds[1].Registry != "old.io" {
+				t.Errorf("credentials = %+v", creds)
+			}
+			for _, cred := range creds {
+				if cred.Password != "" {
+					t.Errorf("password of %s listed", cred.Registry)
+				}
+			}
+
+			other := &AppRegistry{db: reg.db}
+			if _, err := other.GetRegistryCredential("new.io"); !errors.Is(err, ErrSecretKey) {
+				t.Errorf("reading without the key: %v, want %v", err, ErrSecretKey)
+			}
+			// listing does not need the key
+			if creds, err := other.ListRegistryCredentials(); err != nil || len(creds) != 2 {
+				t.Errorf("listing without the key: %d credentials, %v", len(creds), err)
+			}
+			if err := other.SetSecretKey(bytes.Repeat([]byte{2}, SecretKeySize)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := other.GetRegistryCredential("new.io"); !errors.Is(err, ErrSecretKey) {
+				t.Errorf("reading with another key: %v, want %v", err, ErrSecretKey)
+			}
+		})
+	}
+}
+
+func TestLoadSecretKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "secret.key")
+	created, err := LoadSecretKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != SecretKeySize {
+		t.Fatalf("created a %d bytes key", len(created))
+	}
+	loaded, err := LoadSecretKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(created, loaded) {
+		t.Error("the key read back differs from the one created")
+	}
+}
@@ -0,0 +1,195 @@
+package app_registry
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUnknownScope = errors.New("unknown token scope")
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// TokenScope is what an API token may do. Each scope includes the ones
+// before it: read, then deploy, then admin.
+type TokenScope string
+
+const (
+	// ScopeRead reads apps, their state and jobs.
+	ScopeRead TokenScope = "read"
+	// ScopeDeploy also registers, updates, starts and stops apps.
+	ScopeDeploy TokenScope = "deploy"
+	// ScopeAdmin also deletes apps and manages credentials and tokens.
+	ScopeAdmin TokenScope = "admin"
+)
+
+func (s TokenScope) rank() int {
+	switch s {
+	case ScopeRead:
+		return 1
+	case ScopeDeploy:
+		return 2
+	case ScopeAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// Allows tells whether a token with the scope may do what needs required.
+func (s TokenScope) Allows(required TokenScope) bool {
+	return s.rank() > 0 && s.rank() >= required.rank()
+}
+
+// ApiToken grants access to the REST API. Only the SHA-256 of the secret
+// is stored, the secret itself is shown once, when the token is created.
+//
+// A token of a user acts with the permissions of the user, capped by the
+// scope and apps of the token. A token of no user has every permission its
+// scope allows.
+type ApiToken struct {
+	Name  string     `gorm:"not null" json:"name"`
+	Hash  string     `gorm:"unique;not null" json:"-"`
+	Scope TokenScope `gorm:"not null" json:"scope"`
+	// Apps restricts the token to these apps, none means every app.
+	Apps       NameList   `json:"apps"`
+	UserID     *uint      `gorm:"index" json:"userId,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	gorm.Model
+}
+
+func (t *ApiToken) Restricted() bool {
+	return len(t.Apps) > 0
+}
+
+// AllowsApp tells whether the token may act on the app named.
+func (t *ApiToken) AllowsApp(name string) bool {
+	return !t.Restricted() || t.Apps.Has(name)
+}
+
+func newTokenSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ddu_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateToken adds a token, of the user if not nil, and returns it with its
+// secret.
+func (reg *AppRegistry) CreateToken(name string, scope TokenScope, apps []string, user *User) (*ApiToken, string, error) {
+	if name == "" {
+		return nil, "", errors.New("token name is required")
+	}
+	if scope.rank() == 0 {
+		return nil, "", fmt.Errorf("%w: '%s'", ErrUnknownScope, scope)
+	}
+	for _, app := range apps {
+		if err := validateStringSpecialCharacters(app); err != nil {
+			return nil, "", fmt.Errorf("app '%s': %w", app, err)
+		}
+	}
+
+	secret, err := newTokenSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	hash, err := calcHash(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	token := &ApiToken{
+		Name:  name,
+		Hash:  hash,
+		Scope: scope,
+		Apps:  NameList(apps),
+	}
+	if user != nil {
+		token.UserID = &user.ID
+	}
+	if err := reg.db.Create(token).Error; err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+func (reg *AppRegistry) ListTokens() ([]ApiToken, error) {
+	tokens := []ApiToken{}
+	result := reg.db.Order("id").Find(&tokens)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return tokens, nil
+}
+
+// RevokeToken soft deletes the token, it is kept for the record but no
+// longer authenticates.
+func (reg *AppRegistry) RevokeToken(id uint) error {
+	result := reg.db.Delete(&ApiToken{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Authenticate returns the token the secret belongs to.
+func (reg *AppRegistry) Authenticate(secret string) (*ApiToken, error) {
+	hash, err := calcHash(secret)
+	if err != nil {
+		return nil, err
+	}
+	token := new(ApiToken)
+	err = reg.db.Where("hash = ?", hash).First(token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// TouchToken records the use of the token. Uses closer than a minute to
+// the last recorded one are not written, to keep requests from all writing
+// to the database.
+func (reg *AppRegistry) TouchToken(token *ApiToken) error {
+	now := time.Now()
+	if token.LastUsedAt != nil && now.Sub(*token.LastUsedAt) < time.Minute {
+		return nil
+	}
+	token.LastUsedAt = &now
+	return reg.db.Model(&ApiToken{}).Where("id = ?", token.ID).UpdateColumn("last_used_at", now).Error
+}
+
+// BootstrapToken creates an admin token when no token is active, so a new
+// server, or one whose tokens were all revoked, can be administered. The
+// secret is returned only when a token was created.
+func (reg *AppRegistry) BootstrapToken() (string, error) {
+	var count int64
+	if err := reg.db.Model(&ApiToken{}).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", nil
+	}
+	_, secret, err := reg.CreateToken("bootstrap", ScopeAdmin, nil, nil)
+	return secret, err
+}
+
+// GetAppByIDWithDeleted returns the app, deleted or not.
+func (reg *AppRegistry) GetAppByIDWithDeleted(id uint) (*App, error) {
+	app := new(App)
+	result := reg.db.Unscoped().Where("ID = ?", id).First(app)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return app, nil
+}
@@ -13,10 +13,8 @@ import (
 	is "github.com/go-ozzo/ozzo-validation/v4/is"
 )
 
-var hasher = sha256.New()
-
 func calcHash(s string) (string, error) {
-	defer hasher.Reset()
+	hasher := sha256.New()
 	reader := strings.NewReader(s)
 	if _, err := io.Copy(hasher, reader); err != nil {
 		return "", err
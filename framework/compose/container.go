@@ -0,0 +1,574 @@
+package compose
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+)
+
+var ErrUnsupportedKey = errors.New("unsupported compose key")
+
+// ContainerOptions holds everything needed to create the container of a
+// compose service. The engine accepts a single network on create, so the
+// remaining ones are kept in ExtraNetworks and connected afterwards.
+type ContainerOptions struct {
+	Name             string
+	Config           *container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+	ExtraNetworks    map[string]*network.EndpointSettings
+}
+
+func ContainerName(projectName string, serviceName string) string {
+	return fmt.Sprintf("%s_%s", projectName, serviceName)
+}
+
+func unsupported(service compose.ServiceConfig, key string) error {
+	return fmt.Errorf("%w: service '%s' uses '%s'", ErrUnsupportedKey, service.Name, key)
+}
+
+func checkSupported(service compose.ServiceConfig) error {
+	switch {
+	case service.Image == "":
+		return fmt.Errorf("service '%s' has no image", service.Name)
+	case service.Build != nil:
+		return unsupported(service, "build")
+	case service.ContainerName != "":
+		return unsupported(service, "container_name")
+	case len(service.Secrets) > 0:
+		return unsupported(service, "secrets")
+	case len(service.Configs) > 0:
+		return unsupported(service, "configs")
+	case service.CredentialSpec != nil:
+		return unsupported(service, "credential_spec")
+	case len(service.VolumesFrom) > 0:
+		return unsupported(service, "volumes_from")
+	case service.BlkioConfig != nil:
+		return unsupported(service, "blkio_config")
+	case service.Platform != "":
+		return unsupported(service, "platform")
+	case service.Scale > 1:
+		return unsupported(service, "scale")
+	}
+	switch service.PullPolicy {
+	case "", compose.PullPolicyAlways, compose.PullPolicyNever, compose.PullPolicyMissing, compose.PullPolicyIfNotPresent:
+	case compose.PullPolicyBuild:
+		return unsupported(service, "pull_policy: build")
+	default:
+		return fmt.Errorf("service '%s' has unknown pull_policy '%s'", service.Name, service.PullPolicy)
+	}
+	if deploy := service.Deploy; deploy != nil {
+		switch {
+		case deploy.Mode != "" && deploy.Mode != "replicated":
+			return unsupported(service, "deploy.mode")
+		case len(deploy.Placement.Constraints) > 0 || len(deploy.Placement.Preferences) > 0:
+			return unsupported(service, "deploy.placement")
+		case deploy.Resources.Limits != nil && len(deploy.Resources.Limits.GenericResources) > 0:
+			return unsupported(service, "deploy.resources.limits.generic_resources")
+		case deploy.Resources.Reservations != nil && len(deploy.Resources.Reservations.GenericResources) > 0:
+			return unsupported(service, "deploy.resources.reservations.generic_resources")
+		}
+	}
+	return nil
+}
+
+// ValidateProject checks that every service of the project can be
+// translated into container create options, that the resources it owns
+// are named after the app and that its dependencies can be ordered.
+func ValidateProject(project *compose.Project) error {
+	if err := validateResourceNames(project); err != nil {
+		return err
+	}
+	if _, err := ServiceStartOrder(project); err != nil {
+		return err
+	}
+	for _, service := range project.AllServices() {
+		if _, err := ServiceContainerOptions(project, service, 1); err != nil {
+			return err
+		}
+		if err := validateReplicas(project, service); err != nil {
+			return err
+		}
+		if err := validateBlueGreen(project, service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServiceContainerOptions returns the options of one replica of the
+// service, numbered from 1.
+func ServiceContainerOptions(project *compose.Project, service compose.ServiceConfig, replica int) (*ContainerOptions, error) {
+	if err := checkSupported(service); err != nil {
+		return nil, err
+	}
+
+	config, err := serviceConfig(service)
+	if err != nil {
+		return nil, err
+	}
+	hostConfig, err := serviceHostConfig(project, service)
+	if err != nil {
+		return nil, err
+	}
+	exposed, bindings, err := servicePorts(service)
+	if err != nil {
+		return nil, err
+	}
+	config.ExposedPorts = exposed
+	hostConfig.PortBindings = bindings
+
+	opts := &ContainerOptions{
+		Name:       ReplicaName(project.Name, service, replica),
+		Config:     config,
+		HostConfig: hostConfig,
+	}
+	if err := serviceNetworks(project, service, opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func serviceConfig(service compose.ServiceConfig) (*container.Config, error) {
+	config := &container.Config{
+		Image:      service.Image,
+		Hostname:   service.Hostname,
+		Domainname: service.DomainName,
+		User:       service.User,
+		WorkingDir: service.WorkingDir,
+		Tty:        service.Tty,
+		OpenStdin:  service.StdinOpen,
+		StopSignal: service.StopSignal,
+		MacAddress: service.MacAddress,
+		Env:        serviceEnvironment(service.Environment),
+	}
+	if len(service.Command) > 0 {
+		config.Cmd = strslice.StrSlice(service.Command)
+	}
+	if len(service.Entrypoint) > 0 {
+		config.Entrypoint = strslice.StrSlice(service.Entrypoint)
+	}
+	if len(service.Labels) > 0 {
+		config.Labels = map[string]string{}
+		for k, v := range service.Labels {
+			config.Labels[k] = v
+		}
+	}
+	if service.StopGracePeriod != nil {
+		timeout := int(time.Duration(*service.StopGracePeriod).Seconds())
+		config.StopTimeout = &timeout
+	}
+	if service.HealthCheck != nil {
+		config.Healthcheck = serviceHealthcheck(service.HealthCheck)
+	}
+	return config, nil
+}
+
+func serviceEnvironment(env compose.MappingWithEquals) []string {
+	var vars []string
+	for k, v := range env {
+		if v == nil {
+			continue
+		}
+		vars = append(vars, fmt.Sprintf("%s=%s", k, *v))
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+func serviceHealthcheck(hc *compose.HealthCheckConfig) *container.HealthConfig {
+	if hc.Disable {
+		return &container.HealthConfig{Test: []string{"NONE"}}
+	}
+	health := &container.HealthConfig{
+		Test: hc.Test,
+	}
+	if hc.Interval != nil {
+		health.Interval = time.Duration(*hc.Interval)
+	}
+	if hc.Timeout != nil {
+		health.Timeout = time.Duration(*hc.Timeout)
+	}
+	if hc.StartPeriod != nil {
+		health.StartPeriod = time.Duration(*hc.StartPeriod)
+	}
+	if hc.Retries != nil {
+		health.Retries = int(*hc.Retries)
+	}
+	return health
+}
+
+func serviceHostConfig(project *compose.Project, service compose.ServiceConfig) (*container.HostConfig, error) {
+	hostConfig := &container.HostConfig{
+		CapAdd:         service.CapAdd,
+		CapDrop:        service.CapDrop,
+		DNS:            service.DNS,
+		DNSOptions:     service.DNSOpts,
+		DNSSearch:      service.DNSSearch,
+		ExtraHosts:     service.ExtraHosts,
+		GroupAdd:       service.GroupAdd,
+		IpcMode:        container.IpcMode(service.Ipc),
+		PidMode:        container.PidMode(service.Pid),
+		UTSMode:        container.UTSMode(service.Uts),
+		UsernsMode:     container.UsernsMode(service.UserNSMode),
+		Isolation:      container.Isolation(service.Isolation),
+		OomScoreAdj:    int(service.OomScoreAdj),
+		Privileged:     service.Privileged,
+		ReadonlyRootfs: service.ReadOnly,
+		SecurityOpt:    service.SecurityOpt,
+		ShmSize:        int64(service.ShmSize),
+		Runtime:        service.Runtime,
+		Init:           service.Init,
+		VolumeDriver:   service.VolumeDriver,
+	}
+	if len(service.Sysctls) > 0 {
+		hostConfig.Sysctls = map[string]string(service.Sysctls)
+	}
+	for _, link := range service.Links {
+		parts := strings.SplitN(link, ":", 2)
+		alias := parts[0]
+		if len(parts) == 2 {
+			alias = parts[1]
+		}
+		hostConfig.Links = append(hostConfig.Links, fmt.Sprintf("%s:%s", ContainerName(project.Name, parts[0]), alias))
+	}
+	hostConfig.Links = append(hostConfig.Links, service.ExternalLinks...)
+
+	restart, err := serviceRestartPolicy(service)
+	if err != nil {
+		return nil, err
+	}
+	hostConfig.RestartPolicy = restart
+
+	resources, err := serviceResources(service)
+	if err != nil {
+		return nil, err
+	}
+	hostConfig.Resources = resources
+
+	if service.Logging != nil {
+		hostConfig.LogConfig = container.LogConfig{
+			Type:   service.Logging.Driver,
+			Config: service.Logging.Options,
+		}
+	}
+
+	mounts, err := serviceMounts(project, service)
+	if err != nil {
+		return nil, err
+	}
+	hostConfig.Mounts = mounts
+	if len(service.Tmpfs) > 0 {
+		hostConfig.Tmpfs = map[string]string{}
+		for _, tmpfs := range service.Tmpfs {
+			parts := strings.SplitN(tmpfs, ":", 2)
+			if len(parts) == 2 {
+				hostConfig.Tmpfs[parts[0]] = parts[1]
+			} else {
+				hostConfig.Tmpfs[parts[0]] = ""
+			}
+		}
+	}
+
+	switch {
+	case service.NetworkMode == "":
+	case strings.HasPrefix(service.NetworkMode, compose.NetworkModeServicePrefix):
+		dep := strings.TrimPrefix(service.NetworkMode, compose.NetworkModeServicePrefix)
+		hostConfig.NetworkMode = container.NetworkMode("container:" + ContainerName(project.Name, dep))
+	default:
+		hostConfig.NetworkMode = container.NetworkMode(service.NetworkMode)
+	}
+	return hostConfig, nil
+}
+
+func serviceRestartPolicy(service compose.ServiceConfig) (container.RestartPolicy, error) {
+	if service.Deploy != nil && service.Deploy.RestartPolicy != nil {
+		policy := service.Deploy.RestartPolicy
+		restart := container.RestartPolicy{}
+		switch policy.Condition {
+		case "", "any":
+			restart.Name = compose.RestartPolicyAlways
+		case "none":
+			restart.Name = compose.RestartPolicyNo
+		case compose.RestartPolicyOnFailure:
+			restart.Name = compose.RestartPolicyOnFailure
+			if policy.MaxAttempts != nil {
+				restart.MaximumRetryCount = int(*policy.MaxAttempts)
+			}
+		default:
+			return restart, fmt.Errorf("service '%s' has invalid deploy.restart_policy.condition '%s'", service.Name, policy.Condition)
+		}
+		return restart, nil
+	}
+
+	parts := strings.SplitN(service.Restart, ":", 2)
+	restart := container.RestartPolicy{Name: parts[0]}
+	switch parts[0] {
+	case "", compose.RestartPolicyNo, compose.RestartPolicyAlways, compose.RestartPolicyUnlessStopped:
+		if len(parts) == 2 {
+			return restart, fmt.Errorf("service '%s' has invalid restart '%s'", service.Name, service.Restart)
+		}
+	case compose.RestartPolicyOnFailure:
+		if len(parts) == 2 {
+			count, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return restart, fmt.Errorf("service '%s' has invalid restart '%s'", service.Name, service.Restart)
+			}
+			restart.MaximumRetryCount = count
+		}
+	default:
+		return restart, fmt.Errorf("service '%s' has invalid restart '%s'", service.Name, service.Restart)
+	}
+	return restart, nil
+}
+
+func parseNanoCPUs(service compose.ServiceConfig, cpus string) (int64, error) {
+	value, err := strconv.ParseFloat(cpus, 64)
+	if err != nil {
+		return 0, fmt.Errorf("service '%s' has invalid cpus '%s'", service.Name, cpus)
+	}
+	return int64(value * 1e9), nil
+}
+
+func serviceResources(service compose.ServiceConfig) (container.Resources, error) {
+	resources := container.Resources{
+		CgroupParent:       service.CgroupParent,
+		CPUCount:           service.CPUCount,
+		CPUPercent:         int64(service.CPUPercent),
+		CPUPeriod:          service.CPUPeriod,
+		CPUQuota:           service.CPUQuota,
+		CPURealtimePeriod:  service.CPURTPeriod,
+		CPURealtimeRuntime: service.CPURTRuntime,
+		CPUShares:          service.CPUShares,
+		CpusetCpus:         service.CPUSet,
+		NanoCPUs:           int64(service.CPUS * 1e9),
+		Memory:             int64(service.MemLimit),
+		MemoryReservation:  int64(service.MemReservation),
+		MemorySwap:         int64(service.MemSwapLimit),
+	}
+	if service.MemSwappiness != 0 {
+		swappiness := int64(service.MemSwappiness)
+		resources.MemorySwappiness = &swappiness
+	}
+	if service.OomKillDisable {
+		disable := true
+		resources.OomKillDisable = &disable
+	}
+	if service.PidsLimit != 0 {
+		limit := service.PidsLimit
+		resources.PidsLimit = &limit
+	}
+
+	names := make([]string, 0, len(service.Ulimits))
+	for name := range service.Ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		limit := service.Ulimits[name]
+		ulimit := &units.Ulimit{Name: name, Soft: int64(limit.Soft), Hard: int64(limit.Hard)}
+		if limit.Single != 0 {
+			ulimit.Soft = int64(limit.Single)
+			ulimit.Hard = int64(limit.Single)
+		}
+		resources.Ulimits = append(resources.Ulimits, ulimit)
+	}
+
+	for _, device := range service.Devices {
+		parts := strings.Split(device, ":")
+		mapping := container.DeviceMapping{
+			PathOnHost:        parts[0],
+			PathInContainer:   parts[0],
+			CgroupPermissions: "rwm",
+		}
+		switch len(parts) {
+		case 1:
+		case 2:
+			mapping.PathInContainer = parts[1]
+		case 3:
+			mapping.PathInContainer = parts[1]
+			mapping.CgroupPermissions = parts[2]
+		default:
+			return resources, fmt.Errorf("service '%s' has invalid device '%s'", service.Name, device)
+		}
+		resources.Devices = append(resources.Devices, mapping)
+	}
+
+	if service.Deploy == nil {
+		return resources, nil
+	}
+	if limits := service.Deploy.Resources.Limits; limits != nil {
+		if limits.NanoCPUs != "" {
+			cpus, err := parseNanoCPUs(service, limits.NanoCPUs)
+			if err != nil {
+				return resources, err
+			}
+			resources.NanoCPUs = cpus
+		}
+		if limits.MemoryBytes != 0 {
+			resources.Memory = int64(limits.MemoryBytes)
+		}
+	}
+	if reservations := service.Deploy.Resources.Reservations; reservations != nil {
+		if reservations.MemoryBytes != 0 {
+			resources.MemoryReservation = int64(reservations.MemoryBytes)
+		}
+		for _, device := range reservations.Devices {
+			resources.DeviceRequests = append(resources.DeviceRequests, container.DeviceRequest{
+				Driver:       device.Driver,
+				Count:        int(device.Count),
+				DeviceIDs:    device.IDs,
+				Capabilities: [][]string{device.Capabilities},
+			})
+		}
+	}
+	return resources, nil
+}
+
+func serviceMounts(project *compose.Project, service compose.ServiceConfig) ([]mount.Mount, error) {
+	var mounts []mount.Mount
+	for _, volume := range service.Volumes {
+		m := mount.Mount{
+			Type:        mount.Type(volume.Type),
+			Source:      volume.Source,
+			Target:      volume.Target,
+			ReadOnly:    volume.ReadOnly,
+			Consistency: mount.Consistency(volume.Consistency),
+		}
+		switch volume.Type {
+		case compose.VolumeTypeBind:
+			if volume.Bind != nil && volume.Bind.Propagation != "" {
+				m.BindOptions = &mount.BindOptions{Propagation: mount.Propagation(volume.Bind.Propagation)}
+			}
+		case compose.VolumeTypeVolume:
+			if volume.Source != "" {
+				declared, ok := project.Volumes[volume.Source]
+				if !ok {
+					return nil, fmt.Errorf("service '%s' refers to undefined volume '%s'", service.Name, volume.Source)
+				}
+				m.Source = declared.Name
+			}
+			if volume.Volume != nil {
+				m.VolumeOptions = &mount.VolumeOptions{NoCopy: volume.Volume.NoCopy}
+			}
+		case compose.VolumeTypeTmpfs:
+			if volume.Tmpfs != nil {
+				m.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: volume.Tmpfs.Size}
+			}
+		default:
+			return nil, unsupported(service, fmt.Sprintf("volumes (type %s)", volume.Type))
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+func servicePorts(service compose.ServiceConfig) (nat.PortSet, nat.PortMap, error) {
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+	for _, expose := range service.Expose {
+		proto, ports := nat.SplitProtoPort(expose)
+		start, end, err := nat.ParsePortRange(ports)
+		if err != nil {
+			return nil, nil, fmt.Errorf("service '%s' has invalid expose '%s'", service.Name, expose)
+		}
+		for p := start; p <= end; p++ {
+			port, err := nat.NewPort(proto, strconv.FormatUint(p, 10))
+			if err != nil {
+				return nil, nil, err
+			}
+			exposed[port] = struct{}{}
+		}
+	}
+	for _, p := range service.Ports {
+		proto := p.Protocol
+		if proto == "" {
+			proto = "tcp"
+		}
+		if p.Mode == "host" {
+			return nil, nil, unsupported(service, "ports.mode: host")
+		}
+		port, err := nat.NewPort(proto, strconv.FormatUint(uint64(p.Target), 10))
+		if err != nil {
+			return nil, nil, err
+		}
+		exposed[port] = struct{}{}
+		binding := nat.PortBinding{HostIP: p.HostIP}
+		if p.Published != 0 {
+			binding.HostPort = strconv.FormatUint(uint64(p.Published), 10)
+		}
+		bindings[port] = append(bindings[port], binding)
+	}
+	if len(exposed) == 0 {
+		exposed = nil
+	}
+	if len(bindings) == 0 {
+		bindings = nil
+	}
+	return exposed, bindings, nil
+}
+
+func networkPriority(service compose.ServiceConfig, key string) int {
+	if cfg := service.Networks[key]; cfg != nil {
+		return cfg.Priority
+	}
+	return 0
+}
+
+func serviceNetworks(project *compose.Project, service compose.ServiceConfig, opts *ContainerOptions) error {
+	if service.NetworkMode != "" {
+		if len(service.Networks) > 0 {
+			return fmt.Errorf("service '%s' declares both network_mode and networks", service.Name)
+		}
+		return nil
+	}
+	keys := make([]string, 0, len(service.Networks))
+	for key := range service.Networks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return networkPriority(service, keys[i]) > networkPriority(service, keys[j])
+	})
+	for i, key := range keys {
+		declared, ok := project.Networks[key]
+		if !ok {
+			return fmt.Errorf("service '%s' refers to undefined network '%s'", service.Name, key)
+		}
+		endpoint := &network.EndpointSettings{
+			Aliases: []string{service.Name},
+		}
+		if cfg := service.Networks[key]; cfg != nil {
+			endpoint.Aliases = append(endpoint.Aliases, cfg.Aliases...)
+			if cfg.Ipv4Address != "" || cfg.Ipv6Address != "" {
+				endpoint.IPAMConfig = &network.EndpointIPAMConfig{
+					IPv4Address: cfg.Ipv4Address,
+					IPv6Address: cfg.Ipv6Address,
+				}
+			}
+		}
+		if i == 0 {
+			opts.HostConfig.NetworkMode = container.NetworkMode(declared.Name)
+			opts.NetworkingConfig = &network.NetworkingConfig{
+				EndpointsConfig: map[string]*network.EndpointSettings{declared.Name: endpoint},
+			}
+			continue
+		}
+		if opts.ExtraNetworks == nil {
+			opts.ExtraNetworks = map[string]*network.EndpointSettings{}
+		}
+		opts.ExtraNetworks[declared.Name] = endpoint
+	}
+	return nil
+}
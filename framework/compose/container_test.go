@@ -0,0 +1,349 @@
+package compose
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/go-connections/nat"
+)
+
+// loadOptions loads a compose script of project "app" and returns the
+// options of the first replica of its service "svc".
+func loadOptions(t *testing.T, script string) (*ContainerOptions, error) {
+	t.Helper()
+	project, err := LoadDockerCompose([]byte(script), "app")
+	if err != nil {
+		t.Fatalf("loading compose script: %s", err)
+	}
+	service, err := project.GetService("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ServiceContainerOptions(project, service, 1)
+}
+
+func TestServiceContainerOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		check  func(t *testing.T, opts *ContainerOptions)
+	}{
+		{
+			name: "ports",
+			script: `
+services:
+  svc:
+    image: nginx
+    ports:
+      - "8080:80"
+      - "127.0.0.1:5353:53/udp"
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				want := nat.PortMap{
+					"80/tcp": {{HostPort: "8080"}},
+					"53/udp": {{HostIP: "127.0.0.1", HostPort: "5353"}},
+				}
+				if !reflect.DeepEqual(opts.HostConfig.PortBindings, want) {
+					t.Errorf("port bindings = %v, want %v", opts.HostConfig.PortBindings, want)
+				}
+				if _, ok := opts.Config.ExposedPorts["80/tcp"]; !ok {
+					t.Errorf("80/tcp is not exposed: %v", opts.Config.ExposedPorts)
+				}
+			},
+		},
+		{
+			name: "environment",
+			script: `
+services:
+  svc:
+    image: nginx
+    environment:
+      B: two
+      A: one
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				want := []string{"A=one", "B=two"}
+				if !reflect.DeepEqual(opts.Config.Env, want) {
+					t.Errorf("env = %v, want %v", opts.Config.Env, want)
+				}
+			},
+		},
+		{
+			name: "command",
+			script: `
+services:
+  svc:
+    image: nginx
+    command: ["nginx", "-g", "daemon off;"]
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				want := strslice.StrSlice{"nginx", "-g", "daemon off;"}
+				if !reflect.DeepEqual(opts.Config.Cmd, want) {
+					t.Errorf("cmd = %v, want %v", opts.Config.Cmd, want)
+				}
+			},
+		},
+		{
+			name: "entrypoint",
+			script: `
+services:
+  svc:
+    image: nginx
+    entrypoint: /docker-entrypoint.sh
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				want := strslice.StrSlice{"/docker-entrypoint.sh"}
+				if !reflect.DeepEqual(opts.Config.Entrypoint, want) {
+					t.Errorf("entrypoint = %v, want %v", opts.Config.Entrypoint, want)
+				}
+			},
+		},
+		{
+			name: "volumes",
+			script: `
+services:
+  svc:
+    image: nginx
+    volumes:
+      - data:/data
+      - /etc/hosts:/host/hosts:ro
+volumes:
+  data:
+    name: app_data
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				want := []mount.Mount{
+					{Type: mount.TypeVolume, Source: "app_data", Target: "/data", VolumeOptions: &mount.VolumeOptions{}},
+					{Type: mount.TypeBind, Source: "/etc/hosts", Target: "/host/hosts", ReadOnly: true},
+				}
+				if !reflect.DeepEqual(opts.HostConfig.Mounts, want) {
+					t.Errorf("mounts = %+v, want %+v", opts.HostConfig.Mounts, want)
+				}
+			},
+		},
+		{
+			name: "labels",
+			script: `
+services:
+  svc:
+    image: nginx
+    labels:
+      team: web
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				if opts.Config.Labels["team"] != "web" {
+					t.Errorf("labels = %v, want team=web", opts.Config.Labels)
+				}
+			},
+		},
+		{
+			name: "restart",
+			script: `
+services:
+  svc:
+    image: nginx
+    restart: on-failure:3
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				want := container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 3}
+				if opts.HostConfig.RestartPolicy != want {
+					t.Errorf("restart = %+v, want %+v", opts.HostConfig.RestartPolicy, want)
+				}
+			},
+		},
+		{
+			name: "user",
+			script: `
+services:
+  svc:
+    image: nginx
+    user: "1000:1000"
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				if opts.Config.User != "1000:1000" {
+					t.Errorf("user = %q, want 1000:1000", opts.Config.User)
+				}
+			},
+		},
+		{
+			name: "working_dir",
+			script: `
+services:
+  svc:
+    image: nginx
+    working_dir: /srv
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				if opts.Config.WorkingDir != "/srv" {
+					t.Errorf("working dir = %q, want /srv", opts.Config.WorkingDir)
+				}
+			},
+		},
+		{
+			name: "healthcheck",
+			script: `
+services:
+  svc:
+    image: nginx
+    healthcheck:
+      test: ["CMD", "curl", "-f", "http://localhost"]
+      interval: 10s
+      timeout: 2s
+      retries: 4
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				want := &container.HealthConfig{
+					Test:     []string{"CMD", "curl", "-f", "http://localhost"},
+					Interval: 10 * time.Second,
+					Timeout:  2 * time.Second,
+					Retries:  4,
+				}
+				if !reflect.DeepEqual(opts.Config.Healthcheck, want) {
+					t.Errorf("healthcheck = %+v, want %+v", opts.Config.Healthcheck, want)
+				}
+			},
+		},
+		{
+			name: "resource limits",
+			script: `
+services:
+  svc:
+    image: nginx
+    deploy:
+      resources:
+        limits:
+          cpus: "0.5"
+          memory: 64M
+        reservations:
+          memory: 32M
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				resources := opts.HostConfig.Resources
+				if resources.NanoCPUs != 5e8 {
+					t.Errorf("nano cpus = %d, want 5e8", resources.NanoCPUs)
+				}
+				if resources.Memory != 64<<20 {
+					t.Errorf("memory = %d, want %d", resources.Memory, 64<<20)
+				}
+				if resources.MemoryReservation != 32<<20 {
+					t.Errorf("memory reservation = %d, want %d", resources.MemoryReservation, 32<<20)
+				}
+			},
+		},
+		{
+			name: "networks",
+			script: `
+services:
+  svc:
+    image: nginx
+    networks:
+      front:
+        aliases: [web]
+      back: {}
+networks:
+  front:
+    name: app_front
+  back:
+    name: app_back
+`,
+			check: func(t *testing.T, opts *ContainerOptions) {
+				// without priorities the networks come by name, back first
+				if opts.HostConfig.NetworkMode != "app_back" {
+					t.Errorf("network mode = %q, want app_back", opts.HostConfig.NetworkMode)
+				}
+				if _, ok := opts.NetworkingConfig.EndpointsConfig["app_back"]; !ok {
+					t.Errorf("endpoints = %v, want app_back", opts.NetworkingConfig.EndpointsConfig)
+				}
+				front, ok := opts.ExtraNetworks["app_front"]
+				if !ok {
+					t.Fatalf("extra networks = %v, want app_front", opts.ExtraNetworks)
+				}
+				want := []string{"svc", "web"}
+				if !reflect.DeepEqual(front.Aliases, want) {
+					t.Errorf("aliases = %v, want %v", front.Aliases, want)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := loadOptions(t, test.script)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if opts.Name != "app_svc" {
+				t.Errorf("name = %q, want app_svc", opts.Name)
+			}
+			test.check(t, opts)
+		})
+	}
+}
+
+func TestServiceContainerOptionsUnsupported(t *testing.T) {
+	tests := []struct {
+		key    string
+		script string
+	}{
+		{
+			key: "build",
+			script: `
+services:
+  svc:
+    image: nginx
+    build: .
+`,
+		},
+		{
+			key: "container_name",
+			script: `
+services:
+  svc:
+    image: nginx
+    container_name: web
+`,
+		},
+		{
+			key: "secrets",
+			script: `
+services:
+  svc:
+    image: nginx
+    secrets: [token]
+secrets:
+  token:
+    file: ./token.txt
+`,
+		},
+		{
+			key: "configs",
+			script: `
+services:
+  svc:
+    image: nginx
+    configs: [settings]
+configs:
+  settings:
+    file: ./settings.conf
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			_, err := loadOptions(t, test.script)
+			if !errors.Is(err, ErrUnsupportedKey) {
+				t.Fatalf("error = %v, want %v", err, ErrUnsupportedKey)
+			}
+			want := "unsupported compose key: service 'svc' uses '" + test.key + "'"
+			if err.Error() != want {
+				t.Errorf("error = %q, want %q", err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package compose
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	compose "github.com/compose-spec/compose-go/types"
+)
+
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// ServiceStartOrder returns the service names sorted so that every service
+// comes after the services it depends on (depends_on, links and
+// network_mode: service:). Services without a relation are sorted by name.
+func ServiceStartOrder(project *compose.Project) ([]string, error) {
+	services := map[string]compose.ServiceConfig{}
+	var names []string
+	for _, service := range project.AllServices() {
+		services[service.Name] = service
+		names = append(names, service.Name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var order []string
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("%w: %s", ErrDependencyCycle, strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+		deps := services[name].GetDependencies()
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if _, ok := services[dep]; !ok {
+				return fmt.Errorf("service '%s' depends on undefined service '%s'", name, dep)
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// ServiceDependents returns the names of the services bound to the
+// container of the named service, through network_mode: service: or links.
+// Their containers refer to that container and must be recreated with it.
+func ServiceDependents(project *compose.Project, name string) []string {
+	var dependents []string
+	for _, other := range project.AllServices() {
+		bound := other.NetworkMode == "service:"+name
+		for _, link := range other.Links {
+			if strings.SplitN(link, ":", 2)[0] == name {
+				bound = true
+			}
+		}
+		if bound {
+			dependents = append(dependents, other.Name)
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
@@ -0,0 +1,46 @@
+package compose
+
+import (
+	"fmt"
+	"strings"
+
+	compose "github.com/compose-spec/compose-go/types"
+)
+
+const (
+	LabelApp     = "docker-delta-update-server.app"
+	LabelNetwork = "docker-delta-update-server.network"
+	LabelVolume  = "docker-delta-update-server.volume"
+	// LabelServiceHash is the hash of the service a container was created
+	// from, to tell when the container no longer matches it.
+	LabelServiceHash = "docker-delta-update-server.service-hash"
+
+	// Containers are owned by the app registered under LabelAppID and are
+	// found through these labels, never through their name.
+	LabelAppID    = "docker-delta-update-server.app-id"
+	LabelService  = "docker-delta-update-server.service"
+	LabelReplica  = "docker-delta-update-server.replica"
+	LabelRevision = "docker-delta-update-server.revision"
+)
+
+func resourcePrefix(projectName string) string {
+	return projectName + "_"
+}
+
+// validateResourceNames makes sure every network and volume owned by the
+// project carries the app name as prefix, so apps never share them by
+// accident. External resources are left alone.
+func validateResourceNames(project *compose.Project) error {
+	prefix := resourcePrefix(project.Name)
+	for key, net := range project.Networks {
+		if !net.External.External && !strings.HasPrefix(net.Name, prefix) {
+			return fmt.Errorf("network '%s' must be named with the app prefix '%s'", key, prefix)
+		}
+	}
+	for key, volume := range project.Volumes {
+		if !volume.External.External && !strings.HasPrefix(volume.Name, prefix) {
+			return fmt.Errorf("volume '%s' must be named with the app prefix '%s'", key, prefix)
+		}
+	}
+	return nil
+}
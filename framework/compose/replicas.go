@@ -0,0 +1,136 @@
+package compose
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	compose "github.com/compose-spec/compose-go/types"
+)
+
+// ServiceReplicas is the number of containers the service runs,
+// deploy.replicas or 1.
+func ServiceReplicas(service compose.ServiceConfig) int {
+	if service.Deploy != nil && service.Deploy.Replicas != nil {
+		return int(*service.Deploy.Replicas)
+	}
+	return 1
+}
+
+// ReplicaName is the container name of a replica, numbered from 1. A
+// service with a single replica keeps the plain ContainerName so apps
+// deployed before replicas were supported keep their containers.
+func ReplicaName(projectName string, service compose.ServiceConfig, replica int) string {
+	if ServiceReplicas(service) == 1 {
+		return ContainerName(projectName, service.Name)
+	}
+	return fmt.Sprintf("%s_%d", ContainerName(projectName, service.Name), replica)
+}
+
+func ReplicaNames(projectName string, service compose.ServiceConfig) []string {
+	names := make([]string, ServiceReplicas(service))
+	for i := range names {
+		names[i] = ReplicaName(projectName, service, i+1)
+	}
+	return names
+}
+
+// RolloutConfig is how the replicas of a service are replaced, from
+// deploy.update_config: Parallelism replicas at a time, each batch watched
+// for Monitor and followed by Delay. The update fails once more than
+// MaxFailureRatio of the replicas failed.
+type RolloutConfig struct {
+	Parallelism     int           `json:"parallelism"`
+	Delay           time.Duration `json:"delay"`
+	Monitor         time.Duration `json:"monitor"`
+	MaxFailureRatio float64       `json:"maxFailureRatio"`
+}
+
+func ServiceRollout(service compose.ServiceConfig) RolloutConfig {
+	cfg := RolloutConfig{Parallelism: 1}
+	if service.Deploy == nil || service.Deploy.UpdateConfig == nil {
+		return cfg
+	}
+	update := service.Deploy.UpdateConfig
+	if update.Parallelism != nil {
+		cfg.Parallelism = int(*update.Parallelism)
+	}
+	// as in swarm, 0 updates every replica at once
+	if cfg.Parallelism == 0 || cfg.Parallelism > ServiceReplicas(service) {
+		cfg.Parallelism = ServiceReplicas(service)
+	}
+	cfg.Delay = time.Duration(update.Delay)
+	cfg.Monitor = time.Duration(update.Monitor)
+	// through the decimal form, so 0.2 stays 0.2 and not 0.2000000029
+	cfg.MaxFailureRatio, _ = strconv.ParseFloat(strconv.FormatFloat(float64(update.MaxFailureRatio), 'f', -1, 32), 64)
+	return cfg
+}
+
+// Batches splits the replicas, numbered from 1, in update batches.
+func (cfg RolloutConfig) Batches(replicas int) [][]int {
+	var batches [][]int
+	for start := 1; start <= replicas; start += cfg.Parallelism {
+		end := start + cfg.Parallelism - 1
+		if end > replicas {
+			end = replicas
+		}
+		var batch []int
+		for r := start; r <= end; r++ {
+			batch = append(batch, r)
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// validateReplicas checks that the replicas of a service can run side by
+// side and that other services do not need to pick one of them.
+func validateReplicas(project *compose.Project, service compose.ServiceConfig) error {
+	if service.Deploy != nil {
+		if service.Deploy.Replicas != nil && *service.Deploy.Replicas == 0 {
+			return fmt.Errorf("service '%s' must have at least one replica", service.Name)
+		}
+		if update := service.Deploy.UpdateConfig; update != nil {
+			switch {
+			case update.FailureAction != "" && update.FailureAction != "rollback":
+				return unsupported(service, "deploy.update_config.failure_action: "+update.FailureAction)
+			case update.Order != "" && update.Order != "stop-first":
+				return unsupported(service, "deploy.update_config.order: "+update.Order)
+			case update.MaxFailureRatio < 0 || update.MaxFailureRatio > 1:
+				return fmt.Errorf("service '%s' has max_failure_ratio outside of [0, 1]", service.Name)
+			}
+		}
+	}
+	if ServiceReplicas(service) == 1 {
+		return nil
+	}
+
+	fail := func(reason string) error {
+		return fmt.Errorf("service '%s' cannot run %d replicas: %s", service.Name, ServiceReplicas(service), reason)
+	}
+	for _, p := range service.Ports {
+		if p.Published != 0 {
+			return fail(fmt.Sprintf("it publishes host port %d", p.Published))
+		}
+	}
+	if service.MacAddress != "" {
+		return fail("mac_address is set")
+	}
+	for name, net := range service.Networks {
+		if net != nil && (net.Ipv4Address != "" || net.Ipv6Address != "") {
+			return fail(fmt.Sprintf("it has a static address on network '%s'", name))
+		}
+	}
+	for _, other := range project.AllServices() {
+		if other.NetworkMode == "service:"+service.Name {
+			return fail(fmt.Sprintf("service '%s' shares its network namespace", other.Name))
+		}
+		for _, link := range other.Links {
+			if strings.SplitN(link, ":", 2)[0] == service.Name {
+				return fail(fmt.Sprintf("service '%s' links to it", other.Name))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package compose
+
+import (
+	"fmt"
+
+	compose "github.com/compose-spec/compose-go/types"
+)
+
+const UpdateExtension = "x-update"
+
+type UpdateStrategy string
+
+const (
+	StrategyRecreate  UpdateStrategy = "recreate"
+	StrategyBlueGreen UpdateStrategy = "blue-green"
+)
+
+// UpdateConfig is how a service is replaced when its definition changes,
+// read from the x-update extension of the service:
+//
+//	services:
+//	  web:
+//	    x-update:
+//	      strategy: blue-green
+//
+// Services default to recreate: the old container is stopped before the new
+// one is created.
+type UpdateConfig struct {
+	Strategy UpdateStrategy `json:"strategy"`
+}
+
+func ServiceUpdateConfig(service compose.ServiceConfig) (UpdateConfig, error) {
+	cfg := UpdateConfig{Strategy: StrategyRecreate}
+	raw, ok := service.Extensions[UpdateExtension]
+	if !ok {
+		return cfg, nil
+	}
+	ext, ok := raw.(map[string]interface{})
+	if !ok {
+		return cfg, fmt.Errorf("service '%s': %s must be a mapping", service.Name, UpdateExtension)
+	}
+	for key, value := range ext {
+		switch key {
+		case "strategy":
+			strategy, ok := value.(string)
+			if !ok {
+				return cfg, fmt.Errorf("service '%s': %s.strategy must be a string", service.Name, UpdateExtension)
+			}
+			cfg.Strategy = UpdateStrategy(strategy)
+		default:
+			return cfg, fmt.Errorf("service '%s': unknown key %s.%s", service.Name, UpdateExtension, key)
+		}
+	}
+	switch cfg.Strategy {
+	case StrategyRecreate, StrategyBlueGreen:
+	default:
+		return cfg, fmt.Errorf("service '%s': unknown update strategy '%s'", service.Name, cfg.Strategy)
+	}
+	return cfg, nil
+}
+
+// BlueGreenName is the name the new container of a blue-green service runs
+// under until it replaces the old one.
+func BlueGreenName(projectName string, serviceName string) string {
+	return ContainerName(projectName, serviceName) + "_next"
+}
+
+// BlueGreenOldName is the name the old container of a blue-green service
+// is moved to while the new one takes its name, until it is removed.
+func BlueGreenOldName(projectName string, serviceName string) string {
+	return ContainerName(projectName, serviceName) + "_old"
+}
+
+// validateBlueGreen checks that both containers of a blue-green service can
+// run side by side. Traffic is moved by network aliases only, so the
+// service must be reachable through networks, must not publish host ports
+// or pin addresses the old container still holds, and needs a healthcheck
+// to tell when the new container is ready.
+func validateBlueGreen(project *compose.Project, service compose.ServiceConfig) error {
+	cfg, err := ServiceUpdateConfig(service)
+	if err != nil || cfg.Strategy != StrategyBlueGreen {
+		return err
+	}
+	fail := func(reason string) error {
+		return fmt.Errorf("service '%s' cannot use blue-green updates: %s", service.Name, reason)
+	}
+	switch {
+	case ServiceReplicas(service) > 1:
+		return fail("it has more than one replica, use deploy.update_config instead")
+	case service.NetworkMode != "":
+		return fail("network_mode is set")
+	case len(service.Ports) > 0:
+		return fail("it publishes host ports")
+	case service.MacAddress != "":
+		return fail("mac_address is set")
+	case service.HealthCheck == nil || service.HealthCheck.Disable:
+		return fail("it has no healthcheck")
+	}
+	for name, net := range service.Networks {
+		if net != nil && (net.Ipv4Address != "" || net.Ipv6Address != "") {
+			return fail(fmt.Sprintf("it has a static address on network '%s'", name))
+		}
+	}
+	for _, other := range project.AllServices() {
+		if other.NetworkMode == "service:"+service.Name {
+			return fail(fmt.Sprintf("service '%s' shares its network namespace", other.Name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,456 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/logging"
+	gomysql "github.com/go-sql-driver/mysql"
+	"gopkg.in/yaml.v2"
+)
+
+// Settings are read, each one overriding the ones before: defaults, the
+// YAML file given by -config or DDU_CONFIG, DDU_* environment variables,
+// then command line flags.
+
+// Duration is a time.Duration written like "30s" in the YAML file.
+type Duration time.Duration
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type Config struct {
+	Listen   string         `yaml:"listen"`
+	TLS      TLSConfig      `yaml:"tls"`
+	Docker   DockerConfig   `yaml:"docker"`
+	Database DatabaseConfig `yaml:"database"`
+	// DataDir holds the sqlite registry and the self-signed certificate,
+	// unless they are given elsewhere.
+	DataDir    string           `yaml:"dataDir"`
+	LogLevel   string           `yaml:"logLevel"`
+	Reconciler ReconcilerConfig `yaml:"reconciler"`
+	Jobs       JobsConfig       `yaml:"jobs"`
+	Signing    SigningConfig    `yaml:"signing"`
+	// SecretKey is the file of the key registry passwords are encrypted
+	// with, kept out of the database. It is created if missing; servers
+	// sharing a database must share it.
+	SecretKey string `yaml:"secretKey"`
+	// Bootstrap apps are registered at startup when no app has their name.
+	// With trusted keys each compose file needs its signature next to it,
+	// in a file named after it with .sig appended.
+	Bootstrap []BootstrapApp `yaml:"bootstrap"`
+	// Upstreams are the only update servers images are pulled from as
+	// deltas.
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+}
+
+type TLSConfig struct {
+	Cert              string   `yaml:"cert"`
+	Key               string   `yaml:"key"`
+	ClientCA          string   `yaml:"clientCA"`
+	RequireClientCert bool     `yaml:"requireClientCert"`
+	SelfSigned        bool     `yaml:"selfSigned"`
+	Hosts             []string `yaml:"hosts"`
+}
+
+// Enabled tells whether the API is served over TLS.
+func (t TLSConfig) Enabled() bool {
+	return t.Cert != "" || t.Key != "" || t.SelfSigned
+}
+
+// DockerConfig overrides the DOCKER_* environment variables the engine
+// client reads otherwise.
+type DockerConfig struct {
+	Host       string `yaml:"host"`
+	APIVersion string `yaml:"apiVersion"`
+	TLSVerify  bool   `yaml:"tlsVerify"`
+	// CertPath holds ca.pem, cert.pem and key.pem, as DOCKER_CERT_PATH.
+	CertPath string `yaml:"certPath"`
+}
+
+type DatabaseConfig struct {
+	Driver string `yaml:"driver"`
+	// DSN defaults to app_reg.db in the data directory for sqlite.
+	DSN string `yaml:"dsn"`
+}
+
+type ReconcilerConfig struct {
+	// Interval between two checks of every app, 0 to only check on demand.
+	Interval Duration `yaml:"interval"`
+}
+
+type JobsConfig struct {
+	Workers int `yaml:"workers"`
+	// Retain is how many finished jobs are kept to be looked up.
+	Retain int `yaml:"retain"`
+	// LockLease is how long an app lock lasts unless renewed, so the locks
+	// of a server that died are released.
+	LockLease Duration `yaml:"lockLease"`
+}
+
+type SigningConfig struct {
+	TrustedKeys string `yaml:"trustedKeys"`
+	Key         string `yaml:"key"`
+}
+
+type BootstrapApp struct {
+	Name        string `yaml:"name"`
+	ComposeFile string `yaml:"composeFile"`
+}
+
+// UpstreamConfig is an update server images are pulled from, picked by
+// Name in pull requests.
+type UpstreamConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// CA verifies the certificate of the upstream instead of the system
+	// pool.
+	CA string `yaml:"ca"`
+	// Cert and Key are the client certificate presented to the upstream.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Timeout bounds a whole download, DefaultUpstreamTimeout if unset.
+	Timeout Duration `yaml:"timeout"`
+}
+
+const DefaultUpstreamTimeout = time.Hour
+
+func Default() *Config {
+	return &Config{
+		Listen:   ":8080",
+		Database: DatabaseConfig{Driver: app_registry.DriverSQLite},
+		DataDir:  "data",
+		LogLevel: "info",
+		Reconciler: ReconcilerConfig{
+			Interval: Duration(30 * time.Second),
+		},
+		Jobs: JobsConfig{
+			Workers:   4,
+			Retain:    1000,
+			LockLease: Duration(time.Minute),
+		},
+	}
+}
+
+// setting is a value that can come from the environment or a flag.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	bool  bool
+	set   func(c *Config, v string) error
+}
+
+func stringSetting(flag string, env string, usage string, field func(c *Config) *string) setting {
+	return setting{flag: flag, env: env, usage: usage, set: func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func boolSetting(flag string, env string, usage string, field func(c *Config) *bool) setting {
+	return setting{flag: flag, env: env, usage: usage, bool: true, set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		*field(c) = b
+		return err
+	}}
+}
+
+func intSetting(flag string, env string, usage string, field func(c *Config) *int) setting {
+	return setting{flag: flag, env: env, usage: usage, set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		*field(c) = n
+		return err
+	}}
+}
+
+func durationSetting(flag string, env string, usage string, field func(c *Config) *Duration) setting {
+	return setting{flag: flag, env: env, usage: usage, set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		*field(c) = Duration(d)
+		return err
+	}}
+}
+
+var settings = []setting{
+	stringSetting("listen", "DDU_LISTEN", "address the REST API listens on",
+		func(c *Config) *string { return &c.Listen }),
+	stringSetting("tls-cert", "DDU_TLS_CERT", "TLS certificate file, reloaded when it changes; serves the API over TLS with -tls-key",
+		func(c *Config) *string { return &c.TLS.Cert }),
+	stringSetting("tls-key", "DDU_TLS_KEY", "TLS private key file",
+		func(c *Config) *string { return &c.TLS.Key }),
+	stringSetting("tls-client-ca", "DDU_TLS_CLIENT_CA", "CA certificates verifying client certificates; a client without a token is the registry user named by its certificate's common name",
+		func(c *Config) *string { return &c.TLS.ClientCA }),
+	boolSetting("tls-require-client-cert", "DDU_TLS_REQUIRE_CLIENT_CERT", "refuse TLS clients without a verified certificate",
+		func(c *Config) *bool { return &c.TLS.RequireClientCert }),
+	boolSetting("tls-self-signed", "DDU_TLS_SELF_SIGNED", "create a self-signed certificate, in the data directory unless -tls-cert and -tls-key say otherwise, if it does not exist",
+		func(c *Config) *bool { return &c.TLS.SelfSigned }),
+	{flag: "tls-hosts", env: "DDU_TLS_HOSTS", usage: "comma separated host names and addresses of the self-signed certificate",
+		set: func(c *Config, v string) error {
+			c.TLS.Hosts = nil
+			for _, host := range strings.Split(v, ",") {
+				if host = strings.TrimSpace(host); host != "" {
+					c.TLS.Hosts = append(c.TLS.Hosts, host)
+				}
+			}
+			return nil
+		}},
+	stringSetting("docker-host", "DDU_DOCKER_HOST", "Docker engine address, DOCKER_HOST otherwise",
+		func(c *Config) *string { return &c.Docker.Host }),
+	stringSetting("docker-api-version", "DDU_DOCKER_API_VERSION", "Docker engine API version, negotiated otherwise",
+		func(c *Config) *string { return &c.Docker.APIVersion }),
+	boolSetting("docker-tls-verify", "DDU_DOCKER_TLS_VERIFY", "talk to the Docker engine over TLS with the certificates of -docker-cert-path",
+		func(c *Config) *bool { return &c.Docker.TLSVerify }),
+	stringSetting("docker-cert-path", "DDU_DOCKER_CERT_PATH", "directory of ca.pem, cert.pem and key.pem for the Docker engine",
+		func(c *Config) *string { return &c.Docker.CertPath }),
+	stringSetting("db-driver", "DDU_DB_DRIVER", "app registry database driver, 'sqlite' or 'mysql'",
+		func(c *Config) *string { return &c.Database.Driver }),
+	stringSetting("db", "DDU_DB", "app registry database: a file path (':memory:' to keep it in memory) for sqlite, a DSN for mysql; app_reg.db in the data directory by default",
+		func(c *Config) *string { return &c.Database.DSN }),
+	stringSetting("data-dir", "DDU_DATA_DIR", "directory of the data the server keeps",
+		func(c *Config) *string { return &c.DataDir }),
+	stringSetting("log-level", "DDU_LOG_LEVEL", "level of the messages logged, 'debug', 'info', 'warn' or 'error'; 'debug' logs the database queries too, 'warn' and 'error' drop the access log",
+		func(c *Config) *string { return &c.LogLevel }),
+	durationSetting("reconcile-interval", "DDU_RECONCILE_INTERVAL", "interval between two drift checks of every app, 0 to only check on demand",
+		func(c *Config) *Duration { return &c.Reconciler.Interval }),
+	intSetting("job-workers", "DDU_JOB_WORKERS", "number of jobs run at once",
+		func(c *Config) *int { return &c.Jobs.Workers }),
+	intSetting("job-retain", "DDU_JOB_RETAIN", "number of finished jobs kept to be looked up",
+		func(c *Config) *int { return &c.Jobs.Retain }),
+	durationSetting("lock-lease", "DDU_LOCK_LEASE", "how long an app lock lasts unless renewed",
+		func(c *Config) *Duration { return &c.Jobs.LockLease }),
+	stringSetting("trusted-keys", "DDU_TRUSTED_KEYS", "file of trusted ed25519 public keys, one '<key id> <base64 key>' per line; when set, compose scripts, bundles and deltas must be signed by one of them",
+		func(c *Config) *string { return &c.Signing.TrustedKeys }),
+	stringSetting("secret-key", "DDU_SECRET_KEY", "file of the base64 AES-256 key registry passwords are encrypted with, created if missing; servers sharing a database must share it; secret.key in the data directory by default",
+		func(c *Config) *string { return &c.SecretKey }),
+	stringSetting("signing-key", "DDU_SIGNING_KEY", "file holding one '<key id> <base64 ed25519 private key>' line to sign the image deltas served",
+		func(c *Config) *string { return &c.Signing.Key }),
+}
+
+// flagValue collects a flag to apply it once the file and environment
+// are read.
+type flagValue struct {
+	s     *setting
+	value string
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *flagValue) Set(v string) error {
+	f.value = v
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.s.bool
+}
+
+// Load reads the configuration from the file, the environment and the
+// arguments, and validates it. print tells whether -print-config was given.
+func Load(name string, args []string) (cfg *Config, print bool, err error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("DDU_CONFIG"), "YAML configuration file, DDU_CONFIG otherwise")
+	fs.BoolVar(&print, "print-config", false, "print the configuration as read, then exit")
+	values := map[string]*flagValue{}
+	for i := range settings {
+		s := &settings[i]
+		values[s.flag] = &flagValue{s: s}
+		fs.Var(values[s.flag], s.flag, fmt.Sprintf("%s (%s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	cfg = Default()
+	if *path != "" {
+		data, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, false, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+	for i := range settings {
+		s := &settings[i]
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(cfg, v); err != nil {
+				return nil, false, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		v, ok := values[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		if e := v.s.set(cfg, v.value); e != nil {
+			err = fmt.Errorf("-%s: %w", f.Name, e)
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	cfg.applyDataDir()
+	// the configuration printed may be meant for another host, where the
+	// files it names are
+	if err := cfg.validate(!print); err != nil {
+		return nil, false, err
+	}
+	return cfg, print, nil
+}
+
+// applyDataDir places what was left unset in the data directory.
+func (c *Config) applyDataDir() {
+	if c.Database.DSN == "" && c.Database.Driver == app_registry.DriverSQLite {
+		c.Database.DSN = filepath.Join(c.DataDir, "app_reg.db")
+	}
+	if c.SecretKey == "" {
+		c.SecretKey = filepath.Join(c.DataDir, "secret.key")
+	}
+	if c.TLS.SelfSigned && c.TLS.Cert == "" && c.TLS.Key == "" {
+		c.TLS.Cert = filepath.Join(c.DataDir, "tls", "server.crt")
+		c.TLS.Key = filepath.Join(c.DataDir, "tls", "server.key")
+	}
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+// validate checks the files the settings name exist when checkFiles is set.
+func (c *Config) validate(checkFiles bool) error {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		fail("listen: %s", err)
+	}
+	if c.TLS.Enabled() && (c.TLS.Cert == "" || c.TLS.Key == "") {
+		fail("tls: cert and key go together")
+	}
+	if c.TLS.ClientCA != "" && !c.TLS.Enabled() {
+		fail("tls.clientCA: client certificates need TLS")
+	}
+	if c.TLS.RequireClientCert && c.TLS.ClientCA == "" {
+		fail("tls.requireClientCert: needs tls.clientCA")
+	}
+	if c.Docker.TLSVerify && c.Docker.CertPath == "" {
+		fail("docker.tlsVerify: needs docker.certPath")
+	}
+	switch c.Database.Driver {
+	case app_registry.DriverSQLite, app_registry.DriverMySQL:
+		if c.Database.DSN == "" {
+			fail("database.dsn: required for %s", c.Database.Driver)
+		}
+	default:
+		fail("database.driver: unknown driver '%s'", c.Database.Driver)
+	}
+	if c.DataDir == "" {
+		fail("dataDir: required")
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		fail("logLevel: %s", err)
+	}
+	if c.Reconciler.Interval < 0 || (c.Reconciler.Interval > 0 && time.Duration(c.Reconciler.Interval) < time.Second) {
+		fail("reconciler.interval: must be 0 or at least 1s")
+	}
+	if c.Jobs.Workers < 1 {
+		fail("jobs.workers: must be at least 1")
+	}
+	if c.Jobs.Retain < 1 {
+		fail("jobs.retain: must be at least 1")
+	}
+	if time.Duration(c.Jobs.LockLease) < 10*time.Second {
+		fail("jobs.lockLease: must be at least 10s")
+	}
+	names := map[string]bool{}
+	for i, app := range c.Bootstrap {
+		switch {
+		case app.Name == "":
+			fail("bootstrap[%d].name: required", i)
+		case names[app.Name]:
+			fail("bootstrap[%d].name: '%s' is listed twice", i, app.Name)
+		}
+		names[app.Name] = true
+		if app.ComposeFile == "" {
+			fail("bootstrap[%d].composeFile: required", i)
+		} else if checkFiles {
+			if _, err := os.Stat(app.ComposeFile); err != nil {
+				fail("bootstrap[%d].composeFile: %s", i, err)
+			}
+		}
+	}
+	upstreams := map[string]bool{}
+	for i, upstream := range c.Upstreams {
+		switch {
+		case upstream.Name == "":
+			fail("upstreams[%d].name: required", i)
+		case upstreams[upstream.Name]:
+			fail("upstreams[%d].name: '%s' is listed twice", i, upstream.Name)
+		}
+		upstreams[upstream.Name] = true
+		if u, err := url.Parse(upstream.URL); err != nil {
+			fail("upstreams[%d].url: %s", i, err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("upstreams[%d].url: '%s' is not an http or https URL", i, upstream.URL)
+		}
+		if (upstream.Cert == "") != (upstream.Key == "") {
+			fail("upstreams[%d]: cert and key go together", i)
+		}
+		if upstream.Timeout < 0 {
+			fail("upstreams[%d].timeout: must not be negative", i)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// YAML renders the configuration as a file Load would read back, with the
+// database password masked.
+func (c *Config) YAML() ([]byte, error) {
+	printed := *c
+	if c.Database.Driver == app_registry.DriverMySQL {
+		if dsn, err := gomysql.ParseDSN(c.Database.DSN); err == nil && dsn.Passwd != "" {
+			dsn.Passwd = "xxxxx"
+			printed.Database.DSN = dsn.FormatDSN()
+		}
+	}
+	return yaml.Marshal(&printed)
+}
@@ -0,0 +1,54 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	librsync "github.com/balena-os/librsync-go"
+)
+
+// Patch applies a delta to the basis it was computed against and writes
+// the new file. librsync-go only notices a delta cut short when it misses
+// its end command: the file written must then be checked, as PullImageDelta
+// does with the manifest of the image.
+func Patch(basis io.ReadSeeker, delta io.Reader, out io.Writer) error {
+	br := bufio.NewReaderSize(delta, 1<<16)
+	var magic librsync.MagicNumber
+	if err := binary.Read(br, binary.BigEndian, &magic); err != nil {
+		return truncated(err)
+	}
+	if magic != librsync.DELTA_MAGIC {
+		return fmt.Errorf("%w: bad delta magic", ErrBadFormat)
+	}
+	var header bytes.Buffer
+	if err := binary.Write(&header, binary.BigEndian, magic); err != nil {
+		return err
+	}
+	err := librsync.Patch(basis, io.MultiReader(&header, br), out)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return truncated(err)
+	case err != nil && strings.HasPrefix(err.Error(), "Bogus command"):
+		return fmt.Errorf("%w: %s", ErrBadFormat, err)
+	}
+	return err
+}
+
+// NewDigest returns the hash a delta from oldImage to newImage is signed
+// by once the delta is written to it. The images are part of it so that a
+// delta signed for others cannot be replayed, oldImage is empty for a
+// delta against no basis.
+func NewDigest(oldImage string, newImage string) hash.Hash {
+	hasher := sha256.New()
+	for _, image := range []string{oldImage, newImage} {
+		binary.Write(hasher, binary.BigEndian, uint32(len(image)))
+		io.WriteString(hasher, image)
+	}
+	return hasher
+}
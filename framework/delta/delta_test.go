@@ -0,0 +1,170 @@
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	librsync "github.com/balena-os/librsync-go"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// roundTrip computes the delta from basis to newFile through a serialized
+// signature and applies it back. Both are read a byte at a time, as a slow
+// stream would deliver them.
+func roundTrip(t *testing.T, basis []byte, newFile []byte) ([]byte, int) {
+	t.Helper()
+	var sigBuf bytes.Buffer
+	if _, err := WriteSignature(iotest.OneByteReader(bytes.NewReader(basis)), &sigBuf); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ReadSignature(iotest.OneByteReader(&sigBuf))
+	if err != nil {
+		t.Fatalf("reading signature: %s", err)
+	}
+
+	var delta bytes.Buffer
+	if err := librsync.Delta(sig, bytes.NewReader(newFile), &delta); err != nil {
+		t.Fatalf("computing delta: %s", err)
+	}
+	size := delta.Len()
+	var out bytes.Buffer
+	if err := Patch(bytes.NewReader(basis), &delta, &out); err != nil {
+		t.Fatalf("patching: %s", err)
+	}
+	return out.Bytes(), size
+}
+
+func TestRoundTrip(t *testing.T) {
+	basis := randomBytes(1, 64<<10)
+	tests := []struct {
+		name    string
+		basis   []byte
+		newFile []byte
+		// maxDelta, if set, checks the basis was reused
+		maxDelta int
+	}{
+		// librsync-go gets new files shorter than a block wrong, saved
+		// images are always longer
+		{name: "empty basis", basis: nil, newFile: basis},
+		{name: "one block", basis: basis, newFile: basis[DefaultBlockLen : 2*DefaultBlockLen], maxDelta: 16},
+		{name: "identical", basis: basis, newFile: basis, maxDelta: 64},
+		{name: "insertion", basis: basis, newFile: concat(basis[:10000], []byte("inserted"), basis[10000:]), maxDelta: 2 * DefaultBlockLen},
+		{name: "deletion", basis: basis, newFile: concat(basis[:10000], basis[20000:]), maxDelta: 2 * DefaultBlockLen},
+		{name: "shifted", basis: basis, newFile: concat([]byte{1, 2, 3}, basis), maxDelta: 2 * DefaultBlockLen},
+		{name: "unrelated", basis: basis, newFile: randomBytes(2, 32<<10)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, size := roundTrip(t, test.basis, test.newFile)
+			if !bytes.Equal(out, test.newFile) {
+				t.Fatalf("patched file differs: %d bytes, want %d", len(out), len(test.newFile))
+			}
+			if test.maxDelta > 0 && size > test.maxDelta {
+				t.Errorf("delta is %d bytes, want at most %d", size, test.maxDelta)
+			}
+		})
+	}
+}
+
+func encodeSignatureHeader(magic librsync.MagicNumber, blockLen uint32, strongLen uint32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, []uint32{uint32(magic), blockLen, strongLen})
+	return buf.Bytes()
+}
+
+func TestReadSignatureCorrupted(t *testing.T) {
+	var valid bytes.Buffer
+	if _, err := WriteSignature(bytes.NewReader(randomBytes(1, 10000)), &valid); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "short header", data: valid.Bytes()[:10]},
+		{name: "bad magic", data: concat([]byte("XXXX"), valid.Bytes()[4:])},
+		{name: "md4", data: concat(encodeSignatureHeader(librsync.MD4_SIG_MAGIC, DefaultBlockLen, strongLen), valid.Bytes()[12:])},
+		{name: "truncated strong sum", data: valid.Bytes()[:valid.Len()-1]},
+		{name: "truncated weak sum", data: valid.Bytes()[:12+2]},
+		{name: "zero block length", data: encodeSignatureHeader(librsync.BLAKE2_SIG_MAGIC, 0, strongLen)},
+		{name: "block length too large", data: encodeSignatureHeader(librsync.BLAKE2_SIG_MAGIC, MaxBlockLen+1, strongLen)},
+		{name: "zero strong length", data: encodeSignatureHeader(librsync.BLAKE2_SIG_MAGIC, DefaultBlockLen, 0)},
+		{name: "strong length too large", data: encodeSignatureHeader(librsync.BLAKE2_SIG_MAGIC, DefaultBlockLen, 1<<31)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadSignature(bytes.NewReader(test.data))
+			if !errors.Is(err, ErrBadFormat) {
+				t.Fatalf("error = %v, want %v", err, ErrBadFormat)
+			}
+		})
+	}
+}
+
+func TestPatchCorrupted(t *testing.T) {
+	basis := randomBytes(1, 8192)
+	command := func(parts ...interface{}) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, librsync.DELTA_MAGIC)
+		for _, part := range parts {
+			binary.Write(&buf, binary.BigEndian, part)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{name: "empty", delta: nil},
+		{name: "bad magic", delta: []byte("XXXX\x00")},
+		{name: "no end", delta: command()},
+		{name: "reserved command", delta: command(librsync.OP_RESERVED_255)},
+		{name: "truncated copy", delta: command(librsync.OP_COPY_N2_N2, uint8(0))},
+		{name: "truncated literal", delta: command(librsync.OP_LITERAL_N1, uint8(100), []byte("short"))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Patch(bytes.NewReader(basis), bytes.NewReader(test.delta), &bytes.Buffer{})
+			if !errors.Is(err, ErrBadFormat) {
+				t.Fatalf("error = %v, want %v", err, ErrBadFormat)
+			}
+		})
+	}
+}
+
+func TestNewDigest(t *testing.T) {
+	digest := func(oldImage, newImage string, delta string) []byte {
+		hasher := NewDigest(oldImage, newImage)
+		hasher.Write([]byte(delta))
+		return hasher.Sum(nil)
+	}
+	signed := digest("app:1", "app:2", "delta")
+	for _, other := range [][]byte{
+		digest("app:0", "app:2", "delta"),
+		digest("app:1", "app:3", "delta"),
+		digest("", "app:2", "delta"),
+		// the names cannot be shifted into one another
+		digest("app:1app:2", "", "delta"),
+		digest("app:1", "app:2", "other"),
+	} {
+		if bytes.Equal(other, signed) {
+			t.Error("digests of different deltas are equal")
+		}
+	}
+}
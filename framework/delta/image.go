@@ -0,0 +1,181 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	librsync "github.com/balena-os/librsync-go"
+	"github.com/beowulf20/docker-delta-update-server/framework/signing"
+	utils "github.com/beowulf20/docker-delta-update-server/framework/utils"
+	"github.com/docker/docker/client"
+)
+
+// Images are diffed as the tarballs `docker save` produces for them. The
+// layers in there are uncompressed, so an image sharing layers or files
+// with the old one mostly turns into block copies.
+
+// ImageSignature writes the signature of the saved image.
+func ImageSignature(ctx context.Context, cli *client.Client, image string, w io.Writer) error {
+	saved, err := cli.ImageSave(ctx, []string{image})
+	if err != nil {
+		return err
+	}
+	defer saved.Close()
+	_, err = WriteSignature(saved, w)
+	return err
+}
+
+// ImageDelta writes the delta that turns the basis described by sig into
+// the saved image. librsync-go adds a byte to new files shorter than a
+// block, a saved image never is, its tar headers and padding alone are.
+func ImageDelta(ctx context.Context, cli *client.Client, image string, sig *librsync.SignatureType, w io.Writer) error {
+	saved, err := cli.ImageSave(ctx, []string{image})
+	if err != nil {
+		return err
+	}
+	defer saved.Close()
+	return librsync.Delta(sig, saved, w)
+}
+
+// PullImageDelta rebuilds newImage on this host from oldImage and loads it.
+// The saved old image is the basis: its signature is sent to the delta
+// endpoint of the server at baseURL, which answers with only what differs.
+// Without oldImage, or if it is not here, the whole image is downloaded.
+// The rebuilt tarball is only loaded if it holds newImage and nothing else.
+//
+// The token, if any, authenticates this host to the server.
+//
+// When keys are trusted the delta must be signed by one of them, for these
+// images, and the id of that key is returned. The signature comes after the
+// delta, so the delta is then kept in a file and only applied once verified.
+func PullImageDelta(ctx context.Context, cli *client.Client, httpClient *http.Client, baseURL string, oldImage string, newImage string, token string, keys *signing.KeyRing, progress func(format string, args ...interface{})) (string, error) {
+	basis, err := ioutil.TempFile("", "delta-basis-*.tar")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(basis.Name())
+	defer basis.Close()
+
+	// from is the basis the delta is asked and signed for
+	from := ""
+	var body bytes.Buffer
+	if oldImage != "" {
+		saved, err := cli.ImageSave(ctx, []string{oldImage})
+		switch {
+		case client.IsErrNotFound(err):
+			progress("%s not found, downloading %s whole", oldImage, newImage)
+		case err != nil:
+			return "", err
+		default:
+			read := &countingReader{r: io.TeeReader(saved, basis)}
+			_, err = WriteSignature(read, &body)
+			saved.Close()
+			if err != nil {
+				return "", err
+			}
+			from = oldImage
+			progress("signed %s: %d bytes", oldImage, read.n)
+		}
+	}
+	if from == "" {
+		if _, err := WriteSignature(bytes.NewReader(nil), &body); err != nil {
+			return "", err
+		}
+	}
+
+	endpoint := strings.TrimSuffix(baseURL, "/") + "/api/v1/delta/images/delta?" + url.Values{
+		"from":  {from},
+		"image": {newImage},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		var answer struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(msg, &answer) == nil && answer.Error.Message != "" {
+			msg = []byte(answer.Error.Message)
+		}
+		return "", fmt.Errorf("delta server answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	received := &countingReader{r: resp.Body}
+	var delta io.Reader = received
+	keyID := ""
+	if keys.Required() {
+		spooled, err := ioutil.TempFile("", "delta-*.bin")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+		hasher := NewDigest(from, newImage)
+		if _, err := io.Copy(io.MultiWriter(spooled, hasher), received); err != nil {
+			return "", err
+		}
+		// trailers are only there once the body is read to its end
+		keyID, err = keys.Verify(hasher.Sum(nil), resp.Trailer.Get(signing.Header))
+		if err != nil {
+			return "", fmt.Errorf("delta of %s: %w", newImage, err)
+		}
+		progress("delta of %s is signed by %s", newImage, keyID)
+		if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		delta = spooled
+	}
+
+	rebuilt, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Patch(basis, delta, pw))
+	}()
+	bundle, err := utils.SaveImageBundle(rebuilt)
+	if err != nil {
+		rebuilt.CloseWithError(err)
+		return "", fmt.Errorf("delta of %s: %w", newImage, err)
+	}
+	defer bundle.Close()
+	if err := utils.CheckBundleImage(bundle, newImage); err != nil {
+		return "", fmt.Errorf("delta of %s: %w", newImage, err)
+	}
+	if err := utils.LoadImageBundle(ctx, cli, bundle, progress); err != nil {
+		return "", err
+	}
+	progress("loaded %s from a %d bytes delta", newImage, received.n)
+
+	_, _, err = cli.ImageInspectWithRaw(ctx, newImage)
+	return keyID, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
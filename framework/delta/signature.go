@@ -0,0 +1,111 @@
+// Package delta transfers images as rsync deltas: the receiver sends the
+// signature of the image it has, the sender answers with the commands that
+// rebuild the new image from it.
+//
+// Signatures and deltas are librsync's, BLAKE2 signatures made and applied
+// by librsync-go, so they can be checked with rdiff. librsync-go trusts what
+// it reads, this package bounds it first: a signature from the network is
+// read up to MaxSignatureBlocks blocks of at most MaxBlockLen bytes, and a
+// delta is only applied to a basis in a file. librsync-go holds the literal
+// bytes between two matches in memory, an image sharing nothing with its
+// basis is held whole while its delta is computed. Deltas are signed by the
+// server, with the images they go from and to, see NewDigest.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	librsync "github.com/balena-os/librsync-go"
+)
+
+var ErrBadFormat = errors.New("not a delta stream")
+
+const (
+	DefaultBlockLen = 2048
+	// MaxBlockLen and MaxSignatureBlocks bound what a signature read from
+	// the network may ask to be allocated: MaxSignatureBlocks blocks of
+	// DefaultBlockLen describe an 8 GiB image in 80 MiB of sums.
+	MaxBlockLen        = 1 << 20
+	MaxSignatureBlocks = 1 << 22
+	// strongLen is how many bytes of the BLAKE2 of a block are kept.
+	strongLen = 16
+)
+
+// WriteSignature writes the signature of the basis and returns it.
+func WriteSignature(basis io.Reader, w io.Writer) (*librsync.SignatureType, error) {
+	return librsync.Signature(fullReader{basis}, w, DefaultBlockLen, strongLen, librsync.BLAKE2_SIG_MAGIC)
+}
+
+// ReadSignature reads a signature written by WriteSignature. The header is
+// checked and the block table bounded before librsync-go reads it,
+// signatures come from other hosts.
+func ReadSignature(r io.Reader) (*librsync.SignatureType, error) {
+	var header struct {
+		Magic     librsync.MagicNumber
+		BlockLen  uint32
+		StrongLen uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, truncated(err)
+	}
+	if header.Magic != librsync.BLAKE2_SIG_MAGIC {
+		return nil, fmt.Errorf("%w: not a BLAKE2 signature", ErrBadFormat)
+	}
+	if header.BlockLen == 0 || header.BlockLen > MaxBlockLen {
+		return nil, fmt.Errorf("%w: block length %d out of range", ErrBadFormat, header.BlockLen)
+	}
+	if header.StrongLen == 0 || header.StrongLen > librsync.BLAKE2_SUM_LENGTH {
+		return nil, fmt.Errorf("%w: strong sum length %d out of range", ErrBadFormat, header.StrongLen)
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, header); err != nil {
+		return nil, err
+	}
+	max := int64(MaxSignatureBlocks) * int64(4+header.StrongLen)
+	blocks := &io.LimitedReader{R: bufio.NewReader(r), N: max + 1}
+	sig, err := librsync.ReadSignature(fullReader{io.MultiReader(&buf, blocks)})
+	if blocks.N == 0 {
+		return nil, fmt.Errorf("%w: more than %d blocks", ErrBadFormat, MaxSignatureBlocks)
+	}
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return nil, truncated(err)
+	case err != nil && strings.HasPrefix(err.Error(), "got only"):
+		// a strong sum cut short
+		return nil, fmt.Errorf("%w: %s", ErrBadFormat, err)
+	case err != nil:
+		return nil, err
+	}
+	return sig, nil
+}
+
+// fullReader fills every read unless the stream ends. librsync-go takes a
+// short read for the last block of a basis or the end of a strong sum,
+// while a pipe or a network stream may return less at any time.
+type fullReader struct {
+	r io.Reader
+}
+
+func (f fullReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(f.r, p)
+	if err == io.ErrUnexpectedEOF {
+		// the end, the next read tells
+		err = nil
+	}
+	return n, err
+}
+
+// truncated reports a stream that ends too early as ErrBadFormat.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated stream", ErrBadFormat)
+	}
+	return err
+}
@@ -0,0 +1,261 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/beowulf20/docker-delta-update-server/framework/logging"
+)
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	// ErrPanicked fails a job whose function panicked.
+	ErrPanicked = errors.New("job panicked")
+)
+
+type Step struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// View is a consistent copy of a job, safe to serialize while the job keeps
+// running.
+type View struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	AppID      uint        `json:"appId"`
+	Status     Status      `json:"status"`
+	Steps      []Step      `json:"steps"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	StartedAt  *time.Time  `json:"startedAt,omitempty"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+}
+
+func (v View) Done() bool {
+	return v.Status == StatusSucceeded || v.Status == StatusFailed
+}
+
+type Func func(ctx context.Context, job *Job) (interface{}, error)
+
+type Job struct {
+	mu      sync.Mutex
+	view    View
+	changed chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// lost is why the job lost its lock, if it did
+	lost error
+}
+
+// Progress records a step of the job and wakes up whoever is watching it.
+func (job *Job) Progress(format string, args ...interface{}) {
+	job.update(func(v *View) {
+		v.Steps = append(v.Steps, Step{Time: time.Now(), Message: fmt.Sprintf(format, args...)})
+	})
+}
+
+func (job *Job) View() View {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	view := job.view
+	view.Steps = append([]Step{}, job.view.Steps...)
+	return view
+}
+
+// Wait blocks until the job has more than seen steps, is done, or ctx ends.
+func (job *Job) Wait(ctx context.Context, seen int) View {
+	for {
+		job.mu.Lock()
+		changed := job.changed
+		ready := len(job.view.Steps) > seen || job.view.Done()
+		job.mu.Unlock()
+		if ready {
+			return job.View()
+		}
+		select {
+		case <-ctx.Done():
+			return job.View()
+		case <-changed:
+		}
+	}
+}
+
+func (job *Job) update(fn func(v *View)) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	fn(&job.view)
+	close(job.changed)
+	job.changed = make(chan struct{})
+}
+
+// Locker keeps two jobs from working on the same app at once. A lock can
+// be lost while held, a lease that could not be renewed: lost is then
+// called with the reason.
+type Locker interface {
+	Lock(appID uint, holder string, operation string, lost func(err error)) error
+	Unlock(appID uint, holder string)
+}
+
+// Manager runs jobs in the background, at most workers at a time, and keeps
+// the last retain finished jobs around for inspection.
+type Manager struct {
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	finished []string
+	slots    chan struct{}
+	retain   int
+	locker   Locker
+}
+
+func NewManager(workers int, retain int, locker Locker) *Manager {
+	return &Manager{
+		jobs:   map[string]*Job{},
+		slots:  make(chan struct{}, workers),
+		retain: retain,
+		locker: locker,
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Submit queues fn as a job on the app. The app is locked until the job
+// ends, if it already is the locker error is returned and nothing runs.
+// Jobs that work on no app pass appID 0 and take no lock. If the lock is
+// lost on the way the context of fn is cancelled and the job fails.
+func (m *Manager) Submit(kind string, appID uint, fn Func) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		view: View{
+			ID:        id,
+			Kind:      kind,
+			AppID:     appID,
+			Status:    StatusQueued,
+			Steps:     []Step{},
+			CreatedAt: time.Now(),
+		},
+		changed: make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if m.locker != nil && appID != 0 {
+		if err := m.locker.Lock(appID, id, kind, job.loseLock); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	m.jobs[id] = job
+	m.mu.Unlock()
+
+	go m.run(job, fn)
+	return job, nil
+}
+
+func (m *Manager) run(job *Job, fn Func) {
+	m.slots <- struct{}{}
+	// whatever fn does, the slot, the lock and the job are released
+	defer func() {
+		job.cancel()
+		<-m.slots
+		if m.locker != nil && job.view.AppID != 0 {
+			m.locker.Unlock(job.view.AppID, job.view.ID)
+		}
+		m.retire(job.view.ID)
+	}()
+
+	job.update(func(v *View) {
+		now := time.Now()
+		v.Status = StatusRunning
+		v.StartedAt = &now
+	})
+
+	result, err := call(job, fn)
+	job.mu.Lock()
+	lost := job.lost
+	job.mu.Unlock()
+	if lost != nil {
+		// whatever fn made of its cancelled context, this is why
+		result, err = nil, lost
+	}
+
+	job.update(func(v *View) {
+		now := time.Now()
+		v.FinishedAt = &now
+		v.Result = result
+		if err != nil {
+			v.Status = StatusFailed
+			v.Error = err.Error()
+			return
+		}
+		v.Status = StatusSucceeded
+	})
+}
+
+// call runs fn, turning a panic into the error of the job.
+func call(job *Job, fn Func) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Errorf("job %s panicked: %v\n%s", job.view.ID, r, debug.Stack())
+			result, err = nil, fmt.Errorf("%w: %v", ErrPanicked, r)
+		}
+	}()
+	return fn(job.ctx, job)
+}
+
+// loseLock stops a job that no longer holds the lock of its app.
+func (job *Job) loseLock(err error) {
+	job.mu.Lock()
+	job.lost = err
+	job.mu.Unlock()
+	job.Progress("stopping: %s", err)
+	job.cancel()
+}
+
+func (m *Manager) retire(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.finished = append(m.finished, id)
+	for len(m.finished) > m.retain {
+		delete(m.jobs, m.finished[0])
+		m.finished = m.finished[1:]
+	}
+}
+
+func (m *Manager) Get(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level orders the messages of the server, the ones below the level set are
+// dropped.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Levels are the names of the levels, in order.
+var Levels = []string{"debug", "info", "warn", "error"}
+
+var level = int32(LevelInfo)
+
+// ParseLevel returns the level named name.
+func ParseLevel(name string) (Level, error) {
+	for i, l := range Levels {
+		if l == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("'%s' is not one of %s", name, strings.Join(Levels, ", "))
+}
+
+// SetLevel drops the messages below l from now on.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// Enabled tells whether messages of level l are logged.
+func Enabled(l Level) bool {
+	return l >= Level(atomic.LoadInt32(&level))
+}
+
+func logf(l Level, format string, args ...interface{}) {
+	if Enabled(l) {
+		log.Printf(format, args...)
+	}
+}
+
+func Debugf(format string, args ...interface{}) { logf(LevelDebug, format, args...) }
+func Infof(format string, args ...interface{})  { logf(LevelInfo, format, args...) }
+func Warnf(format string, args ...interface{})  { logf(LevelWarn, format, args...) }
+func Errorf(format string, args ...interface{}) { logf(LevelError, format, args...) }
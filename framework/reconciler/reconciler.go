@@ -0,0 +1,160 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	"github.com/beowulf20/docker-delta-update-server/framework/logging"
+	utils "github.com/beowulf20/docker-delta-update-server/framework/utils"
+	"github.com/docker/docker/client"
+)
+
+// Report is the outcome of the last check of an app.
+type Report struct {
+	AppID     uint                    `json:"appId"`
+	App       string                  `json:"app"`
+	CheckedAt time.Time               `json:"checkedAt"`
+	Policy    app_registry.HealPolicy `json:"healPolicy"`
+	Drift     []utils.Drift           `json:"drift"`
+	Error     string                  `json:"error,omitempty"`
+	// HealJob is the job started to heal the drift, if any.
+	HealJob string `json:"healJob,omitempty"`
+}
+
+// Reconciler periodically compares every registered app with its
+// containers and, when the app's heal policy allows it, submits a heal job.
+// Heal jobs go through the job manager, so apps busy with another operation
+// are left alone until the next round.
+type Reconciler struct {
+	reg      *app_registry.AppRegistry
+	cli      *client.Client
+	manager  *jobs.Manager
+	interval time.Duration
+
+	mu      sync.Mutex
+	reports map[uint]Report
+}
+
+func New(reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		reg:      reg,
+		cli:      cli,
+		manager:  manager,
+		interval: interval,
+		reports:  map[uint]Report{},
+	}
+}
+
+// Run checks all apps every interval until ctx ends.
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.CheckAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) CheckAll(ctx context.Context) {
+	apps, err := r.reg.ListApps()
+	if err != nil {
+		logging.Errorf("reconciler: %s", err)
+		return
+	}
+	seen := map[uint]bool{}
+	for _, app := range apps {
+		seen[app.ID] = true
+		r.Check(ctx, app)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id := range r.reports {
+		if !seen[id] {
+			delete(r.reports, id)
+		}
+	}
+}
+
+// Check detects the drift of the app, records it and starts healing it if
+// the policy says so.
+func (r *Reconciler) Check(ctx context.Context, app app_registry.App) Report {
+	report := r.Detect(ctx, app)
+	if report.Error == "" && len(utils.Healable(report.Drift, app.HealPolicy)) > 0 {
+		job, err := r.Heal(app.ID)
+		if err == nil {
+			report.HealJob = job.View().ID
+		} else if !errors.Is(err, app_registry.ErrAppLocked) {
+			report.Error = err.Error()
+		}
+	}
+
+	r.mu.Lock()
+	r.reports[app.ID] = report
+	r.mu.Unlock()
+	return report
+}
+
+// Detect detects the drift of the app, without recording or healing it.
+func (r *Reconciler) Detect(ctx context.Context, app app_registry.App) Report {
+	report := Report{
+		AppID:     app.ID,
+		App:       app.Name,
+		CheckedAt: time.Now(),
+		Policy:    app.HealPolicy,
+		Drift:     []utils.Drift{},
+	}
+	drifts, err := utils.DetectDrift(ctx, r.cli, app)
+	if err != nil {
+		report.Error = err.Error()
+	} else {
+		report.Drift = drifts
+	}
+	return report
+}
+
+// Heal submits a job that detects the drift again, now that the app is
+// locked, and heals what the policy allows.
+func (r *Reconciler) Heal(appID uint) (*jobs.Job, error) {
+	return r.manager.Submit("heal", appID, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		app, err := r.reg.GetAppByID(appID)
+		if err != nil {
+			return nil, err
+		}
+		drifts, err := utils.DetectDrift(ctx, r.cli, *app)
+		if err != nil {
+			return nil, err
+		}
+		healable := utils.Healable(drifts, app.HealPolicy)
+		return healable, utils.HealDrift(ctx, r.cli, *app, healable, utils.RegistryAuthFrom(r.reg), job.Progress)
+	})
+}
+
+func (r *Reconciler) Report(appID uint) (Report, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report, ok := r.reports[appID]
+	return report, ok
+}
+
+func (r *Reconciler) Reports() []Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reports := []Report{}
+	for _, report := range r.reports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].AppID < reports[j].AppID
+	})
+	return reports
+}
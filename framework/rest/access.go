@@ -0,0 +1,170 @@
+package framework_rest
+
+import (
+	"net/http"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/gin-gonic/gin"
+)
+
+func userList(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		users, err := reg.ListUsers()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, users)
+	}
+}
+
+func userCreate(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		user, err := reg.CreateUser(body.Name)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, user)
+	}
+}
+
+// userRemove deletes the user, its role bindings and its tokens.
+func userRemove(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, ok := idParam(c, "id")
+		if !ok {
+			return
+		}
+		if err := reg.RemoveUser(id); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id": id,
+		})
+	}
+}
+
+func roleList(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		roles, err := reg.ListRoles()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, roles)
+	}
+}
+
+// roleSet creates the role of the :name parameter or replaces its
+// permissions.
+func roleSet(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Permissions []app_registry.Permission `json:"permissions" binding:"required"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		role, err := reg.SetRole(c.Param("name"), body.Permissions)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, role)
+	}
+}
+
+func roleRemove(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := reg.RemoveRole(c.Param("name")); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"name": c.Param("name"),
+		})
+	}
+}
+
+func bindingList(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		bindings, err := reg.ListBindings()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, bindings)
+	}
+}
+
+// bindingCreate gives a role to a user on the apps named and matching the
+// label selector, on every app when neither is given.
+func bindingCreate(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			User     string   `json:"user" binding:"required"`
+			Role     string   `json:"role" binding:"required"`
+			Apps     []string `json:"apps"`
+			Selector string   `json:"selector"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		binding, err := reg.BindRole(body.User, body.Role, body.Apps, body.Selector)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, binding)
+	}
+}
+
+func bindingRemove(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, ok := idParam(c, "id")
+		if !ok {
+			return
+		}
+		if err := reg.RemoveBinding(id); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id": id,
+		})
+	}
+}
+
+// regSetAppLabels replaces the labels of the app. Labels decide which role
+// bindings apply to the app, so they are managed with access, not with the
+// app.
+func regSetAppLabels(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, ok := idParam(c, "id")
+		if !ok {
+			return
+		}
+		var body struct {
+			Labels app_registry.Labels `json:"labels" binding:"required"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		if err := reg.SetAppLabels(id, body.Labels); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id":     id,
+			"labels": body.Labels,
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package framework_rest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	utils "github.com/beowulf20/docker-delta-update-server/framework/utils"
+	"github.com/docker/docker/client"
+	"github.com/gin-gonic/gin"
+)
+
+func queryBool(c *gin.Context, key string, def bool) (bool, error) {
+	v := c.Query(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s '%s'", key, v)
+	}
+	return b, nil
+}
+
+// regDeleteApp removes the containers of the app, its networks unless
+// ?networks=false, and its volumes and images with ?volumes=true and
+// ?images=true, then soft deletes it.
+func regDeleteApp(reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParam(c, reg)
+		if !ok {
+			return
+		}
+
+		opts := utils.RemoveOptions{}
+		for key, dst := range map[string]*bool{"networks": &opts.Networks, "volumes": &opts.Volumes, "images": &opts.Images} {
+			v, err := queryBool(c, key, key == "networks")
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			*dst = v
+		}
+		info := revisionInfo(c, "deleted")
+
+		job, err := manager.Submit("delete", app.ID, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			err := utils.RemoveApp(ctx, cli, *app, opts, job.Progress)
+			if err != nil {
+				return nil, err
+			}
+			return reg.DeleteApp(app.ID, app_registry.AppDeletion{
+				Author:         info.Author,
+				Message:        info.Message,
+				RemovedVolumes: opts.Volumes,
+				RemovedImages:  opts.Images,
+			})
+		})
+		if err != nil {
+			jobSubmitError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, job.View())
+	}
+}
+
+func regListDeletedApps(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		apps, err := reg.ListDeletedApps()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		data := []gin.H{}
+		for _, app := range allowedApps(c, app_registry.PermAppsRead, apps) {
+			deletions, err := reg.ListDeletions(app.ID)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+			data = append(data, gin.H{
+				"id":        app.ID,
+				"name":      app.Name,
+				"hash":      app.ComposeHash,
+				"revision":  app.Revision,
+				"deletedAt": app.DeletedAt.Time,
+				"deletions": deletions,
+			})
+		}
+		c.JSON(http.StatusOK, data)
+	}
+}
+
+// regRestoreApp restores a deleted app in a job, so it takes the app lock
+// and cannot run while the deletion is still removing containers.
+func regRestoreApp(reg *app_registry.AppRegistry, manager *jobs.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParamWithDeleted(c, reg)
+		if !ok {
+			return
+		}
+
+		job, err := manager.Submit("restore", app.ID, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			app, err := reg.RestoreApp(app.ID)
+			if err != nil {
+				return nil, err
+			}
+			return gin.H{
+				"id":       app.ID,
+				"name":     app.Name,
+				"revision": app.Revision,
+				"stopped":  app.Stopped,
+			}, nil
+		})
+		if err != nil {
+			jobSubmitError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, job.View())
+	}
+}
@@ -1,32 +1,33 @@
 package framework_rest
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
+	"time"
 
 	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
 	app_compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	"github.com/beowulf20/docker-delta-update-server/framework/signing"
 	utils "github.com/beowulf20/docker-delta-update-server/framework/utils"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
+	ctypes "github.com/compose-spec/compose-go/types"
 	"github.com/docker/docker/client"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func appRegListAll(reg *app_registry.AppRegistry) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		apps, err := reg.ListApps()
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			respondError(c, http.StatusInternalServerError, err)
 			return
 		}
 
-		var data []gin.H
-		for _, app := range apps {
+		data := []gin.H{}
+		for _, app := range allowedApps(c, app_registry.PermAppsRead, apps) {
 			data = append(data, gin.H{
 				"id":       app.ID,
 				"name":     app.Name,
@@ -40,36 +41,25 @@ func appRegListAll(reg *app_registry.AppRegistry) func(c *gin.Context) {
 
 func appParseApp(reg *app_registry.AppRegistry, cli *client.Client) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
-			return
-		}
-
-		app, err := reg.GetAppByID(uint(id))
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+		app, ok := appParam(c, reg)
+		if !ok {
 			return
 		}
 
 		conts, err := utils.AssociateContainerApp(*app, cli)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			respondError(c, http.StatusBadGateway, err)
 			return
 		}
 
-		var containersMap []map[string]interface{}
+		containersMap := []map[string]interface{}{}
 		for _, cont := range conts {
 			containersMap = append(containersMap, map[string]interface{}{
-				"name":   cont.Service.Name,
-				"status": cont.Status.ToString(),
-				"image":  cont.Service.Image,
+				"name":      cont.Service.Name,
+				"replica":   cont.Replica,
+				"container": cont.Name,
+				"status":    cont.Status.ToString(),
+				"image":     cont.Service.Image,
 				"volumes": func() []string {
 					volumes := []string{}
 					for _, volume := range cont.Service.Volumes {
@@ -83,325 +73,406 @@ func appParseApp(reg *app_registry.AppRegistry, cli *client.Client) func(c *gin.
 		c.JSON(http.StatusOK, map[string]interface{}{
 			"id":         app.ID,
 			"name":       app.Name,
+			"stopped":    app.Stopped,
+			"healPolicy": app.HealPolicy,
 			"containers": containersMap,
 		})
 
 	}
 }
 
-func regStopApp(reg *app_registry.AppRegistry, cli *client.Client) func(c *gin.Context) {
+func regStopApp(reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+		app, ok := appParam(c, reg)
+		if !ok {
 			return
 		}
 
-		app, err := reg.GetAppByID(uint(id))
+		job, err := manager.Submit("stop", app.ID, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			if err := reg.SetStopped(app.ID, true); err != nil {
+				return nil, err
+			}
+			return nil, utils.StopApp(ctx, cli, *app, job.Progress)
+		})
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			jobSubmitError(c, err)
 			return
 		}
+		c.JSON(http.StatusAccepted, job.View())
+	}
+}
 
-		conts, err := utils.AssociateContainerApp(*app, cli)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+func regStartApp(reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParam(c, reg)
+		if !ok {
 			return
 		}
 
-		for _, cont := range conts {
-			if cont.Status == utils.ContainerRunning {
-				err = cli.ContainerStop(c, cont.Container.ID, nil)
-				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{
-						"error": err.Error(),
-					})
-					return
-				}
+		job, err := manager.Submit("start", app.ID, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			if err := reg.SetStopped(app.ID, false); err != nil {
+				return nil, err
 			}
+			return nil, utils.StartApp(ctx, cli, *app, utils.RegistryAuthFrom(reg), job.Progress)
+		})
+		if err != nil {
+			jobSubmitError(c, err)
+			return
 		}
-
+		c.JSON(http.StatusAccepted, job.View())
 	}
 }
 
-func regStartApp(reg *app_registry.AppRegistry, cli *client.Client) func(c *gin.Context) {
+// regAdoptApp adopts the containers of the app created before ownership
+// labels, see utils.AdoptContainers.
+func regAdoptApp(reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+		app, ok := appParam(c, reg)
+		if !ok {
 			return
 		}
 
-		app, err := reg.GetAppByID(uint(id))
+		job, err := manager.Submit("adopt", app.ID, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			return utils.AdoptContainers(ctx, cli, *app, utils.RegistryAuthFrom(reg), job.Progress)
+		})
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			jobSubmitError(c, err)
 			return
 		}
+		c.JSON(http.StatusAccepted, job.View())
+	}
+}
 
-		conts, err := utils.AssociateContainerApp(*app, cli)
+type appUpdate struct {
+	id         uint
+	oldApp     *app_registry.App
+	newApp     *app_registry.App
+	newProject *ctypes.Project
+	plan       *utils.UpdatePlan
+}
+
+func prepareAppUpdate(reg *app_registry.AppRegistry, cli *client.Client, id uint, script string) (*appUpdate, error) {
+	oldApp, err := reg.GetAppByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	newApp, err := app_registry.NewApp(oldApp.Name, script)
+	if err != nil {
+		return nil, err
+	}
+
+	oldProject, err := app_compose.LoadDockerCompose([]byte(oldApp.ComposeScript), oldApp.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	newProject, err := app_compose.LoadDockerCompose([]byte(newApp.ComposeScript), oldApp.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// the callers answer 422 for an invalid script, not for the engine
+	oldConts, err := utils.AssociateContainerApp(*oldApp, cli)
+	if err != nil {
+		return nil, upstreamError{err}
+	}
+
+	plan, err := utils.NewUpdatePlan(oldProject, oldConts, newProject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &appUpdate{
+		id:         id,
+		oldApp:     oldApp,
+		newApp:     newApp,
+		newProject: newProject,
+		plan:       plan,
+	}, nil
+}
+
+// appParam returns the app of the :id parameter, answering the request if
+// there is none.
+func appParam(c *gin.Context, reg *app_registry.AppRegistry) (*app_registry.App, bool) {
+	return loadAppParam(c, reg.GetAppByID)
+}
+
+// appParamWithDeleted is appParam for an app that may be deleted.
+func appParamWithDeleted(c *gin.Context, reg *app_registry.AppRegistry) (*app_registry.App, bool) {
+	return loadAppParam(c, reg.GetAppByIDWithDeleted)
+}
+
+func loadAppParam(c *gin.Context, get func(id uint) (*app_registry.App, error)) (*app_registry.App, bool) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return nil, false
+	}
+	app, err := get(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		abortWithError(c, http.StatusNotFound, codeNotFound, fmt.Sprintf("no app %d", id), gin.H{"id": id})
+		return nil, false
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return app, true
+}
+
+// verifyParam reads the verification window from the verify query
+// parameter, utils.DefaultVerifyWindow otherwise, answering the request if
+// it is invalid.
+func verifyParam(c *gin.Context) (time.Duration, bool) {
+	v := c.Query("verify")
+	if v == "" {
+		return utils.DefaultVerifyWindow, true
+	}
+	verify, err := time.ParseDuration(v)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, codeBadRequest,
+			fmt.Sprintf("invalid verify '%s'", v), gin.H{"param": "verify"})
+		return 0, false
+	}
+	return verify, true
+}
+
+// runAppUpdate submits a job that applies the update, see applyAppUpdate.
+// It is shared by update and rollback. The update was prepared before the
+// app was locked, so the job prepares it again: it fails if the app moved
+// to another revision meanwhile, or if the plan is no longer planID when
+// one was given, and applies the plan as it is now otherwise.
+func runAppUpdate(c *gin.Context, reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager, kind string, update *appUpdate, planID string, info app_registry.RevisionInfo) {
+	verify, ok := verifyParam(c)
+	if !ok {
+		return
+	}
+
+	job, err := manager.Submit(kind, update.id, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		current, err := prepareAppUpdate(reg, cli, update.id, update.newApp.ComposeScript)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
-			return
+			return nil, err
 		}
+		if current.oldApp.Revision != update.oldApp.Revision {
+			return nil, fmt.Errorf("%w: submitted against revision %d, the app is at %d",
+				app_registry.ErrRevisionChanged, update.oldApp.Revision, current.oldApp.Revision)
+		}
+		if planID != "" && current.plan.ID != planID {
+			return nil, fmt.Errorf("%w: the app changed since plan %s", errPlanOutdated, planID)
+		}
+		return applyAppUpdate(ctx, reg, cli, current, info, verify, job)
+	})
+	if err != nil {
+		jobSubmitError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, job.View())
+}
 
-		for _, cont := range conts {
-			if cont.Status == utils.ContainerRunning {
-				continue
-			}
-			if cont.Status == utils.ContainerNotCreated {
-				newContBody, err := cli.ContainerCreate(c, &container.Config{
-					Image: cont.Service.Image,
-				}, nil, nil, nil, app.Name+"_"+cont.Service.Name)
-				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{
-						"error": err.Error(),
-					})
-					return
-				}
-				err = cli.ContainerStart(c, newContBody.ID, types.ContainerStartOptions{})
-				if err != nil {
-					c.JSON(401, gin.H{
-						"error": err.Error(),
-					})
-					return
-				}
-				continue
-			}
+// applyAppUpdate records the new revision, applies the plan and watches the
+// started services for the verification window. If applying or verifying
+// fails, the previous revision is redeployed. It runs in a job holding the
+// app.
+func applyAppUpdate(ctx context.Context, reg *app_registry.AppRegistry, cli *client.Client, update *appUpdate, info app_registry.RevisionInfo, verify time.Duration, job *jobs.Job) (gin.H, error) {
+	willUpdate := update.plan.HasChanges()
+	revision := update.oldApp.Revision
+	result := gin.H{
+		"hash": map[string]string{
+			"old": update.plan.OldHash,
+			"new": update.plan.NewHash,
+		},
+		"didUpdate":  willUpdate,
+		"revision":   revision,
+		"rolledBack": false,
+		"plan":       update.plan,
+	}
+	if !willUpdate {
+		return result, nil
+	}
 
-			err = cli.ContainerStart(c, cont.Container.ID, types.ContainerStartOptions{})
-			if err != nil {
-				c.JSON(401, gin.H{
-					"error": err.Error(),
-				})
-				return
-			}
-		}
+	// a missing image fails the update before anything changed
+	err := utils.PullPlanImages(ctx, cli, update.newProject, update.plan, utils.RegistryAuthFrom(reg), job.Progress)
+	if err != nil {
+		return result, err
+	}
+
+	rev, err := reg.UpdateApp(update.id, update.oldApp.Revision, update.newApp, info)
+	if err != nil {
+		return nil, err
+	}
+	result["revision"] = rev.Number
+	job.Progress("recorded revision %d", rev.Number)
+	// applying the plan starts the app
+	if err := reg.SetStopped(update.id, false); err != nil {
+		return result, err
+	}
 
+	owner := utils.Owner{AppID: update.id, App: update.oldApp.Name, Revision: rev.Number}
+	err = utils.ApplyUpdatePlan(ctx, cli, owner, update.newProject, update.plan, job.Progress)
+	if err == nil {
+		err = utils.VerifyServices(ctx, cli, update.id, update.newProject, update.plan.StartedServices(), verify, job.Progress)
+	}
+	if err == nil {
+		return result, nil
 	}
+
+	job.Progress("revision %d failed: %s", rev.Number, err)
+	back, rbErr := rollbackAppUpdate(ctx, reg, cli, update, rev, err, info, job)
+	if rbErr != nil {
+		return result, fmt.Errorf("%s, rollback failed: %w", err, rbErr)
+	}
+	result["revision"] = back.Number
+	result["rolledBack"] = true
+	result["rollbackReason"] = err.Error()
+	return result, fmt.Errorf("update rolled back: %w", err)
 }
 
-func regUpdateApp(reg *app_registry.AppRegistry, cli *client.Client) func(c *gin.Context) {
+// rollbackAppUpdate redeploys the compose script the app had before update
+// as a new revision, and flags the failed one.
+func rollbackAppUpdate(ctx context.Context, reg *app_registry.AppRegistry, cli *client.Client, update *appUpdate, failed *app_registry.AppRevision, reason error, info app_registry.RevisionInfo, job *jobs.Job) (*app_registry.AppRevision, error) {
+	back, err := prepareAppUpdate(reg, cli, update.id, update.oldApp.ComposeScript)
+	if err != nil {
+		return nil, err
+	}
+
+	err = reg.MarkRevisionRolledBack(update.id, failed.Number)
+	if err != nil {
+		return nil, err
+	}
+	signedBy, err := revisionSigner(reg, update.oldApp)
+	if err != nil {
+		return nil, err
+	}
+	rev, err := reg.UpdateApp(update.id, failed.Number, back.newApp, app_registry.RevisionInfo{
+		Author:   info.Author,
+		Message:  fmt.Sprintf("automatic rollback of revision %d: %s", failed.Number, reason),
+		SignedBy: signedBy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	job.Progress("rolling back to revision %d as revision %d", update.oldApp.Revision, rev.Number)
+
+	err = utils.PullPlanImages(ctx, cli, back.newProject, back.plan, utils.RegistryAuthFrom(reg), job.Progress)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := utils.Owner{AppID: update.id, App: update.oldApp.Name, Revision: rev.Number}
+	err = utils.ApplyUpdatePlan(ctx, cli, owner, back.newProject, back.plan, job.Progress)
+	if err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+// revisionInfo records who made a change, the principal of the request,
+// and why, ?message= or else message.
+func revisionInfo(c *gin.Context, message string) app_registry.RevisionInfo {
+	if m := c.Query("message"); m != "" {
+		message = m
+	}
+	return app_registry.RevisionInfo{
+		Author:  currentPrincipal(c).name(),
+		Message: message,
+	}
+}
+
+func regPlanApp(reg *app_registry.AppRegistry, cli *client.Client) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		id, err := strconv.ParseUint(c.Param("id"), 10, 32)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+		id, ok := idParam(c, "id")
+		if !ok {
 			return
 		}
-		oldApp, err := reg.GetAppByID(uint(id))
+
+		composeData, err := c.GetRawData()
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			badRequest(c, err)
 			return
 		}
 
-		composeData, err := c.GetRawData()
+		update, err := prepareAppUpdate(reg, cli, id, string(composeData))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			respondError(c, http.StatusUnprocessableEntity, err)
 			return
 		}
+		c.JSON(http.StatusOK, update.plan)
+	}
+}
 
-		newApp, err := app_registry.NewApp(oldApp.Name, string(composeData))
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+func regUpdateApp(reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager, keys *signing.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, ok := idParam(c, "id")
+		if !ok {
 			return
 		}
 
-		oldProject, err := app_compose.LoadDockerCompose([]byte(oldApp.ComposeScript), oldApp.Name)
+		composeData, err := c.GetRawData()
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			badRequest(c, err)
 			return
 		}
 
-		newProject, err := app_compose.LoadDockerCompose([]byte(newApp.ComposeScript), oldApp.Name)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+		signedBy, ok := verifyScript(c, keys, composeData)
+		if !ok {
 			return
 		}
 
-		err = reg.UpdateApp(uint(id), string(composeData))
+		update, err := prepareAppUpdate(reg, cli, id, string(composeData))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			respondError(c, http.StatusUnprocessableEntity, err)
 			return
 		}
 
-		payload1, _ := json.Marshal(newProject)
-		payload2, _ := json.Marshal(oldProject)
-		oldHash, _ := app_registry.CalculateHash(payload1)
-		newHash, _ := app_registry.CalculateHash(payload2)
-
-		willUpdate := oldHash != newHash
-
-		if willUpdate {
-			err = reg.UpdateApp(uint(id), string(composeData))
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"error": err.Error(),
-				})
-				return
-			}
-			oldConts, err := utils.AssociateContainerApp(*oldApp, cli)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"error": err.Error(),
-				})
-				return
-			}
-			newConts, err := utils.AssociateContainerApp(*newApp, cli)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"error": err.Error(),
-				})
-				return
-			}
-
-			hashes := make(map[string]map[string]string)
-			hashes["old"] = make(map[string]string)
-			hashes["new"] = make(map[string]string)
-			for _, cont := range oldConts {
-				hash, _ := cont.CalculateServiceHash()
-				hashes["old"][cont.Service.Name] = hash
-			}
-			for _, cont := range newConts {
-				hash, _ := cont.CalculateServiceHash()
-				hashes["new"][cont.Service.Name] = hash
-			}
-
-			// CHECK BY HASH WHATS CHANGED
-			for newContName, newContHash := range hashes["new"] {
-				for oldContName, oldContHash := range hashes["old"] {
-					if newContHash == oldContHash {
-						if oldContName != newContName {
-							fmt.Print("\n[HASH] OLD NAME => NEW NAME\n")
-							fmt.Printf("[%s] %s => %s\n", newContHash, oldContName, newContName)
-						}
-					}
-				}
-			}
-			// CHECK BY NAME WHATS CHANGED
-			for newContName, newContHash := range hashes["new"] {
-				if oldContHash, ok := hashes["old"][newContName]; ok {
-					if oldContHash != newContHash {
-						fmt.Printf("\n[NAME] OLD HASH => NEW HASH\n")
-						fmt.Printf("[%s] %s => %s\n", newContName, oldContHash, newContHash)
-					}
-				}
-			}
-
-			for _, cont := range oldConts {
-				if cont.Status == utils.ContainerNotCreated {
-					continue
-				}
-				if cont.Status == utils.ContainerRunning {
-					err = cli.ContainerStop(c, cont.Container.ID, nil)
-					if err != nil {
-						c.JSON(http.StatusBadRequest, gin.H{
-							"error": err.Error(),
-						})
-						return
-					}
-				}
-				err = cli.ContainerRemove(c, cont.Container.ID, types.ContainerRemoveOptions{})
-				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{
-						"error": err.Error(),
-					})
-					return
-				}
-			}
-
-			for _, cont := range newConts {
-				if cont.Status == utils.ContainerRunning {
-					continue
-				}
-				if cont.Status == utils.ContainerNotCreated {
-					newContBody, err := cli.ContainerCreate(c, &container.Config{
-						Image: cont.Service.Image,
-					}, nil, nil, nil, newApp.Name+"_"+cont.Service.Name)
-					if err != nil {
-						c.JSON(http.StatusBadRequest, gin.H{
-							"error": err.Error(),
-						})
-						return
-					}
-					err = cli.ContainerStart(c, newContBody.ID, types.ContainerStartOptions{})
-					if err != nil {
-						c.JSON(http.StatusBadRequest, gin.H{
-							"error": err.Error(),
-						})
-						return
-					}
-				}
-				if cont.Status == utils.ContainerNotRunning {
-					err = cli.ContainerStart(c, cont.Container.ID, types.ContainerStartOptions{})
-					if err != nil {
-						c.JSON(http.StatusBadRequest, gin.H{
-							"error": err.Error(),
-						})
-						return
-					}
-				}
-			}
+		// a plan reviewed through /plan is only applied if nothing moved since
+		planID := c.Query("plan")
+		if planID != "" && planID != update.plan.ID {
+			abortWithError(c, http.StatusConflict, codePlanOutdated, errPlanOutdated.Error(), gin.H{
+				"plan": update.plan,
+			})
+			return
 		}
 
-		c.JSON(200, gin.H{
-			"hash": map[string]string{
-				"old": oldHash,
-				"new": newHash,
-			},
-			"didUpdate": willUpdate,
-		})
+		info := revisionInfo(c, "")
+		info.SignedBy = signedBy
+		runAppUpdate(c, reg, cli, manager, "update", update, planID, info)
 	}
 }
 
-func regNewApp(reg *app_registry.AppRegistry, cli *client.Client) func(c *gin.Context) {
+func regNewApp(reg *app_registry.AppRegistry, cli *client.Client, keys *signing.KeyRing) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		composeData, err := c.GetRawData()
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			badRequest(c, err)
+			return
+		}
+
+		signedBy, ok := verifyScript(c, keys, composeData)
+		if !ok {
 			return
 		}
 
 		app, err := app_registry.NewApp("", string(composeData))
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			respondError(c, http.StatusUnprocessableEntity, err)
 			return
 		}
-		err = reg.AddApp(app)
+		if !authorizeApp(c, app_registry.PermAppsCreate, app) {
+			return
+		}
+		info := revisionInfo(c, "registered")
+		info.SignedBy = signedBy
+		err = reg.AddApp(app, info)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			respondError(c, http.StatusInternalServerError, err)
 			return
 		}
-		c.String(http.StatusOK, "OK")
+		c.JSON(http.StatusCreated, gin.H{
+			"id":       app.ID,
+			"name":     app.Name,
+			"hash":     app.ComposeHash,
+			"revision": app.Revision,
+			"stopped":  app.Stopped,
+		})
 	}
 }
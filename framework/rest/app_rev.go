@@ -0,0 +1,154 @@
+package framework_rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	app_compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	"github.com/beowulf20/docker-delta-update-server/framework/signing"
+	utils "github.com/beowulf20/docker-delta-update-server/framework/utils"
+	"github.com/docker/docker/client"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func regListRevisions(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParamWithDeleted(c, reg)
+		if !ok {
+			return
+		}
+
+		revs, err := reg.ListRevisions(app.ID)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		data := []gin.H{}
+		for _, rev := range revs {
+			data = append(data, gin.H{
+				"number":     rev.Number,
+				"hash":       rev.ComposeHash,
+				"author":     rev.Author,
+				"message":    rev.Message,
+				"rolledBack": rev.RolledBack,
+				"signedBy":   rev.SignedBy,
+				"createAt":   rev.CreatedAt,
+			})
+		}
+		c.JSON(http.StatusOK, data)
+	}
+}
+
+func regGetRevision(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParamWithDeleted(c, reg)
+		if !ok {
+			return
+		}
+
+		rev, ok := loadRevision(c, reg, app, "rev", c.Param("rev"))
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, rev)
+	}
+}
+
+// loadRevision returns the revision of the app numbered value, answering
+// the request if there is none. name is the parameter value comes from.
+func loadRevision(c *gin.Context, reg *app_registry.AppRegistry, app *app_registry.App, name string, value string) (*app_registry.AppRevision, bool) {
+	number, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, codeBadRequest,
+			fmt.Sprintf("invalid revision '%s'", value), gin.H{"param": name})
+		return nil, false
+	}
+	rev, err := reg.GetRevision(app.ID, uint(number))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		abortWithError(c, http.StatusNotFound, codeNotFound,
+			fmt.Sprintf("app '%s' has no revision %d", app.Name, number), gin.H{"param": name})
+		return nil, false
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return rev, true
+}
+
+func regDiffRevisions(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParamWithDeleted(c, reg)
+		if !ok {
+			return
+		}
+
+		from, ok := loadRevision(c, reg, app, "from", c.Query("from"))
+		if !ok {
+			return
+		}
+		to, ok := loadRevision(c, reg, app, "to", c.Query("to"))
+		if !ok {
+			return
+		}
+
+		fromProject, err := app_compose.LoadDockerCompose([]byte(from.ComposeScript), app.Name)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		toProject, err := app_compose.LoadDockerCompose([]byte(to.ComposeScript), app.Name)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		diff, err := utils.DiffProjects(fromProject, toProject)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"from": from.Number,
+			"to":   to.Number,
+			"diff": diff,
+		})
+	}
+}
+
+func regRollbackApp(reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager, keys *signing.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParam(c, reg)
+		if !ok {
+			return
+		}
+
+		rev, ok := loadRevision(c, reg, app, "rev", c.Param("rev"))
+		if !ok {
+			return
+		}
+
+		// revisions recorded before signatures were required cannot come back
+		if keys.Required() && rev.SignedBy == "" {
+			abortWithError(c, http.StatusUnprocessableEntity, codeInvalidSignature,
+				fmt.Sprintf("revision %d is not signed", rev.Number), gin.H{"revision": rev.Number})
+			return
+		}
+
+		update, err := prepareAppUpdate(reg, cli, app.ID, rev.ComposeScript)
+		if err != nil {
+			respondError(c, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		info := revisionInfo(c, fmt.Sprintf("rollback to revision %d", rev.Number))
+		info.SignedBy = rev.SignedBy
+		runAppUpdate(c, reg, cli, manager, "rollback", update, "", info)
+	}
+}
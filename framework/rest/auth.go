@@ -0,0 +1,216 @@
+package framework_rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/logging"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const principalKey = "principal"
+
+// principal is who a request acts for: its token and, for a token of a
+// user, the grants of the user. A client identified by its certificate has
+// no token, only the grants of its user.
+type principal struct {
+	token       *app_registry.ApiToken
+	certificate string
+	grants      *app_registry.Grants
+}
+
+func (p *principal) restricted() bool {
+	return p.token != nil && p.token.Restricted()
+}
+
+// name names the principal in the records it leaves, revisions and
+// deletions: the user of a token or certificate, and the token.
+func (p *principal) name() string {
+	switch {
+	case p.token != nil && p.grants != nil:
+		return fmt.Sprintf("%s (token '%s' #%d)", p.grants.User.Name, p.token.Name, p.token.ID)
+	case p.token != nil:
+		return fmt.Sprintf("token '%s' #%d", p.token.Name, p.token.ID)
+	default:
+		return p.certificate
+	}
+}
+
+// denied returns why the permission on the app, nil for a permission not
+// tied to an app, is refused, or an empty string if it is not.
+func (p *principal) denied(perm app_registry.Permission, app *app_registry.App) string {
+	if p.token != nil {
+		if !p.token.Scope.Allows(perm.Scope()) {
+			return fmt.Sprintf("token scope '%s' does not allow '%s'", p.token.Scope, perm)
+		}
+		if app == nil && p.token.Restricted() {
+			return fmt.Sprintf("token is restricted to apps, '%s' is not an app permission", perm)
+		}
+		if app != nil && !p.token.AllowsApp(app.Name) {
+			return fmt.Sprintf("token is not allowed on app '%s'", app.Name)
+		}
+	}
+	if p.grants == nil || p.grants.Allows(perm, app) {
+		return ""
+	}
+	if app == nil {
+		return fmt.Sprintf("user '%s' is missing permission '%s'", p.grants.User.Name, perm)
+	}
+	return fmt.Sprintf("user '%s' is missing permission '%s' on app '%s'", p.grants.User.Name, perm, app.Name)
+}
+
+// authenticate requires every request to carry an API token as
+// "Authorization: Bearer <secret>", or else to come over TLS with a
+// verified client certificate.
+func authenticate(reg *app_registry.AppRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" && c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0 {
+			authenticateCertificate(c, reg)
+			return
+		}
+		secret := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if secret == "" || secret == c.GetHeader("Authorization") {
+			c.Header("WWW-Authenticate", "Bearer")
+			abortWithError(c, http.StatusUnauthorized, codeUnauthorized, "missing bearer token", nil)
+			return
+		}
+		token, err := reg.Authenticate(secret)
+		if errors.Is(err, app_registry.ErrInvalidToken) {
+			c.Header("WWW-Authenticate", "Bearer")
+			abortWithError(c, http.StatusUnauthorized, codeUnauthorized, err.Error(), nil)
+			return
+		}
+		p := &principal{token: token}
+		if err == nil && token.UserID != nil {
+			p.grants, err = reg.UserGrants(*token.UserID)
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if err := reg.TouchToken(token); err != nil {
+			logging.Warnf("recording use of token %d: %s", token.ID, err)
+		}
+		c.Set(principalKey, p)
+		c.Next()
+	}
+}
+
+// authenticateCertificate identifies the client by the common name of its
+// certificate, which names a registry user.
+func authenticateCertificate(c *gin.Context, reg *app_registry.AppRegistry) {
+	name := c.Request.TLS.VerifiedChains[0][0].Subject.CommonName
+	user, err := reg.GetUserByName(name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		abortWithError(c, http.StatusUnauthorized, codeUnauthorized,
+			fmt.Sprintf("no user for client certificate '%s'", name), nil)
+		return
+	}
+	p := &principal{certificate: name}
+	if err == nil {
+		p.grants, err = reg.UserGrants(user.ID)
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Set(principalKey, p)
+	c.Next()
+}
+
+func currentPrincipal(c *gin.Context) *principal {
+	return c.MustGet(principalKey).(*principal)
+}
+
+// forbidden answers 403 naming the permission missing, and the app if any.
+func forbidden(c *gin.Context, perm app_registry.Permission, app *app_registry.App, reason string) {
+	details := gin.H{
+		"permission": perm,
+	}
+	if app != nil {
+		details["app"] = app.Name
+	}
+	abortWithError(c, http.StatusForbidden, codeForbidden, reason, details)
+}
+
+// authorizeApp checks the permission on the app, answering the request if
+// it is refused.
+func authorizeApp(c *gin.Context, perm app_registry.Permission, app *app_registry.App) bool {
+	if reason := currentPrincipal(c).denied(perm, app); reason != "" {
+		forbidden(c, perm, app, reason)
+		return false
+	}
+	return true
+}
+
+// allowGlobal requires a permission not tied to an app.
+func allowGlobal(perm app_registry.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authorizeApp(c, perm, nil) {
+			c.Next()
+		}
+	}
+}
+
+// allowApp requires the permission on the app of the :id parameter.
+// Deleted apps count, so they can be restored.
+func allowApp(reg *app_registry.AppRegistry, perm app_registry.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := idParam(c, "id")
+		if !ok {
+			return
+		}
+		app, err := reg.GetAppByIDWithDeleted(id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// the handler answers for an unknown app, unless the
+			// principal could not have acted on it whatever it was
+			if currentPrincipal(c).restricted() {
+				forbidden(c, perm, nil, "token is not allowed on this app")
+				return
+			}
+			c.Next()
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		if authorizeApp(c, perm, app) {
+			c.Next()
+		}
+	}
+}
+
+// allowedApps filters the apps down to those the principal has the
+// permission on.
+func allowedApps(c *gin.Context, perm app_registry.Permission, apps []app_registry.App) []app_registry.App {
+	p := currentPrincipal(c)
+	allowed := []app_registry.App{}
+	for i := range apps {
+		if p.denied(perm, &apps[i]) == "" {
+			allowed = append(allowed, apps[i])
+		}
+	}
+	return allowed
+}
+
+// whoami describes the token of the request and what its user may do.
+func whoami(c *gin.Context) {
+	p := currentPrincipal(c)
+	body := gin.H{}
+	if p.token != nil {
+		body["token"] = p.token
+	}
+	if p.certificate != "" {
+		body["certificate"] = p.certificate
+	}
+	if p.grants != nil {
+		body["user"] = p.grants.User
+		body["bindings"] = p.grants.Bindings
+	}
+	c.JSON(http.StatusOK, body)
+}
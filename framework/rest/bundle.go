@@ -0,0 +1,198 @@
+package framework_rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	app_compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	"github.com/beowulf20/docker-delta-update-server/framework/signing"
+	utils "github.com/beowulf20/docker-delta-update-server/framework/utils"
+	"github.com/docker/docker/client"
+	"github.com/gin-gonic/gin"
+)
+
+// regUploadBundle loads images for hosts that cannot reach a registry. The
+// request is a multipart form with one or more bundle parts, each a
+// `docker save` tarball, and an optional compose part. The bundles may only
+// hold images of the compose script, the registered one unless given. With
+// ?update=true the app is updated to that script once the engine has every
+// image it needs.
+//
+// When keys are trusted, each bundle part is followed by a bundle.sig part
+// with its signature, and a compose part by a compose.sig part.
+func regUploadBundle(reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager, keys *signing.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParam(c, reg)
+		if !ok {
+			return
+		}
+		update, err := queryBool(c, "update", false)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		verify, ok := verifyParam(c)
+		if !ok {
+			return
+		}
+		info := revisionInfo(c, "offline bundle")
+
+		form, err := readBundleForm(c)
+		bundles := form.bundles
+		// the job owns the bundles once submitted
+		submitted := false
+		defer func() {
+			if !submitted {
+				for _, bundle := range bundles {
+					bundle.Close()
+				}
+			}
+		}()
+		if err == nil && len(bundles) == 0 {
+			err = errors.New("missing bundle")
+		}
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		signedBy := make([]string, len(bundles))
+		for i, bundle := range bundles {
+			sig := ""
+			if i < len(form.bundleSigs) {
+				sig = form.bundleSigs[i]
+			}
+			signedBy[i], ok = verifySignature(c, keys, fmt.Sprintf("bundle %d", i+1), bundle.Digest, sig)
+			if !ok {
+				return
+			}
+		}
+		script := form.script
+		if script != "" {
+			info.SignedBy, ok = verifySignature(c, keys, "compose script", signing.Digest([]byte(script)), form.scriptSig)
+			if !ok {
+				return
+			}
+		} else {
+			script = app.ComposeScript
+			info.SignedBy, err = revisionSigner(reg, app)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		project, err := app_compose.LoadDockerCompose([]byte(script), app.Name)
+		if err == nil {
+			err = utils.CheckBundles(project, bundles)
+		}
+		if err != nil {
+			respondError(c, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		job, err := manager.Submit("bundle", app.ID, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			defer func() {
+				for _, bundle := range bundles {
+					bundle.Close()
+				}
+			}()
+			loaded := []string{}
+			for _, bundle := range bundles {
+				if err := utils.LoadImageBundle(ctx, cli, bundle, job.Progress); err != nil {
+					return nil, err
+				}
+				loaded = append(loaded, bundle.Images...)
+			}
+			missing, err := utils.MissingImages(ctx, cli, project)
+			if err != nil {
+				return nil, err
+			}
+			result := gin.H{
+				"loaded":    loaded,
+				"missing":   missing,
+				"signedBy":  signedBy,
+				"didUpdate": false,
+			}
+			if !update {
+				return result, nil
+			}
+			if len(missing) > 0 {
+				job.Progress("not updating, %d images are still missing", len(missing))
+				return result, nil
+			}
+
+			appUpdate, err := prepareAppUpdate(reg, cli, app.ID, script)
+			if err != nil {
+				return result, err
+			}
+			res, err := applyAppUpdate(ctx, reg, cli, appUpdate, info, verify, job)
+			result["didUpdate"] = appUpdate.plan.HasChanges()
+			result["update"] = res
+			return result, err
+		})
+		if err != nil {
+			jobSubmitError(c, err)
+			return
+		}
+		submitted = true
+		c.JSON(http.StatusAccepted, job.View())
+	}
+}
+
+type bundleForm struct {
+	script     string
+	scriptSig  string
+	bundles    []*utils.ImageBundle
+	bundleSigs []string
+}
+
+// readBundleForm streams the parts of the upload, saving every bundle
+// without holding it in memory. The bundles saved are returned even on
+// error, for the caller to close.
+func readBundleForm(c *gin.Context) (bundleForm, error) {
+	var form bundleForm
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		return form, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			return form, err
+		}
+		switch part.FormName() {
+		case "bundle":
+			bundle, err := utils.SaveImageBundle(part)
+			if err != nil {
+				return form, err
+			}
+			form.bundles = append(form.bundles, bundle)
+		case "bundle.sig", "compose", "compose.sig":
+			// signatures and scripts are small, anything bigger is not one
+			data, err := ioutil.ReadAll(io.LimitReader(part, 1<<20))
+			if err != nil {
+				return form, err
+			}
+			switch part.FormName() {
+			case "bundle.sig":
+				form.bundleSigs = append(form.bundleSigs, strings.TrimSpace(string(data)))
+			case "compose":
+				form.script = string(data)
+			case "compose.sig":
+				form.scriptSig = strings.TrimSpace(string(data))
+			}
+		}
+		part.Close()
+	}
+}
@@ -0,0 +1,120 @@
+package framework_rest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/beowulf20/docker-delta-update-server/framework/delta"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	"github.com/beowulf20/docker-delta-update-server/framework/signing"
+	"github.com/docker/docker/client"
+	"github.com/gin-gonic/gin"
+)
+
+// imageParam returns the image query parameter after checking the image is
+// here, answering the request otherwise.
+func imageParam(c *gin.Context, cli *client.Client) (string, bool) {
+	image := c.Query("image")
+	if image == "" {
+		abortWithError(c, http.StatusBadRequest, codeBadRequest, "missing image", gin.H{"param": "image"})
+		return "", false
+	}
+	if _, _, err := cli.ImageInspectWithRaw(c.Request.Context(), image); err != nil {
+		respondError(c, http.StatusBadGateway, err)
+		return "", false
+	}
+	return image, true
+}
+
+func deltaImageSignature(cli *client.Client) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		image, ok := imageParam(c, cli)
+		if !ok {
+			return
+		}
+		c.Header("Content-Type", "application/octet-stream")
+		c.Status(http.StatusOK)
+		// the status is sent already, a stream cut short is how the client
+		// learns about an error from here
+		if err := delta.ImageSignature(c.Request.Context(), cli, image, c.Writer); err != nil {
+			c.Error(err)
+		}
+	}
+}
+
+// deltaImageDelta answers with the delta from the basis whose signature is
+// the request body, the image ?from= if any, to the image. With a signer
+// the delta is signed with both images, in a trailer since the delta
+// streams out as it is computed.
+func deltaImageDelta(cli *client.Client, signer *signing.Signer) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		image, ok := imageParam(c, cli)
+		if !ok {
+			return
+		}
+		sig, err := delta.ReadSignature(c.Request.Body)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		c.Header("Content-Type", "application/octet-stream")
+		if signer != nil {
+			c.Header("Trailer", signing.Header)
+		}
+		c.Status(http.StatusOK)
+		hasher := delta.NewDigest(c.Query("from"), image)
+		// a delta always ends with an end command, so the client notices
+		// one cut short by an error
+		err = delta.ImageDelta(c.Request.Context(), cli, image, sig, io.MultiWriter(c.Writer, hasher))
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		if signer != nil {
+			c.Writer.Header().Set(signing.Header, signer.Sign(hasher.Sum(nil)))
+		}
+	}
+}
+
+// deltaImagePull rebuilds the image ?to= here from the image ?from= with a
+// delta downloaded from the upstream named ?server=, authenticated with the
+// token in the X-Server-Token header. Only configured upstreams are
+// contacted. When keys are trusted the delta must be signed by one of them.
+func deltaImagePull(cli *client.Client, manager *jobs.Manager, upstreams map[string]Upstream, keys *signing.KeyRing) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		server, from, to := c.Query("server"), c.Query("from"), c.Query("to")
+		token := c.GetHeader("X-Server-Token")
+		if server == "" || to == "" {
+			abortWithError(c, http.StatusBadRequest, codeBadRequest, "server and to are required", gin.H{
+				"params": []string{"server", "to"},
+			})
+			return
+		}
+		upstream, ok := upstreams[server]
+		if !ok {
+			names := []string{}
+			for name := range upstreams {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			abortWithError(c, http.StatusUnprocessableEntity, codeInvalid,
+				fmt.Sprintf("unknown upstream '%s'", server), gin.H{"upstreams": names})
+			return
+		}
+		job, err := manager.Submit("delta-pull", 0, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+			signedBy, err := delta.PullImageDelta(ctx, cli, upstream.Client, upstream.URL, from, to, token, keys, job.Progress)
+			if err != nil {
+				return nil, err
+			}
+			return gin.H{"image": to, "server": server, "signedBy": signedBy}, nil
+		})
+		if err != nil {
+			jobSubmitError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, job.View())
+	}
+}
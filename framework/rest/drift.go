@@ -0,0 +1,84 @@
+package framework_rest
+
+import (
+	"net/http"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/reconciler"
+	"github.com/gin-gonic/gin"
+)
+
+func driftListAll(reg *app_registry.AppRegistry, rec *reconciler.Reconciler) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		apps, err := reg.ListApps()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		allowed := map[uint]bool{}
+		for _, app := range allowedApps(c, app_registry.PermAppsRead, apps) {
+			allowed[app.ID] = true
+		}
+		reports := []reconciler.Report{}
+		for _, report := range rec.Reports() {
+			if allowed[report.AppID] {
+				reports = append(reports, report)
+			}
+		}
+		c.JSON(http.StatusOK, reports)
+	}
+}
+
+// regAppDrift checks the app right away instead of returning the last
+// report of the reconciler. It only reports, healing is regHealApp.
+func regAppDrift(reg *app_registry.AppRegistry, rec *reconciler.Reconciler) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParam(c, reg)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, rec.Detect(c.Request.Context(), *app))
+	}
+}
+
+// regHealApp heals the drift of the app its heal policy allows, without
+// waiting for the reconciler.
+func regHealApp(reg *app_registry.AppRegistry, rec *reconciler.Reconciler) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		app, ok := appParam(c, reg)
+		if !ok {
+			return
+		}
+		job, err := rec.Heal(app.ID)
+		if err != nil {
+			jobSubmitError(c, err)
+			return
+		}
+		c.JSON(http.StatusAccepted, job.View())
+	}
+}
+
+func regSetHealPolicy(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, ok := idParam(c, "id")
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Policy app_registry.HealPolicy `json:"policy" binding:"required"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		err := reg.SetHealPolicy(id, body.Policy)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id":         id,
+			"healPolicy": body.Policy,
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package framework_rest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	app_compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	"github.com/beowulf20/docker-delta-update-server/framework/delta"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	"github.com/beowulf20/docker-delta-update-server/framework/logging"
+	"github.com/beowulf20/docker-delta-update-server/framework/signing"
+	utils "github.com/beowulf20/docker-delta-update-server/framework/utils"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+// Error codes, stable for clients to act on unlike the messages.
+const (
+	codeBadRequest       = "bad_request"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeAlreadyExists    = "already_exists"
+	codeConflict         = "conflict"
+	codeAppLocked        = "app_locked"
+	codePlanOutdated     = "plan_outdated"
+	codeInvalid          = "invalid"
+	codeInvalidSignature = "invalid_signature"
+	codeDockerNotFound   = "docker_not_found"
+	codeDockerConflict   = "docker_conflict"
+	codeUpstreamError    = "upstream_error"
+	codeInternal         = "internal"
+)
+
+// errPlanOutdated fails an update whose reviewed plan no longer matches
+// the app.
+var errPlanOutdated = errors.New("plan is outdated")
+
+// apiError is the body of every error answer, under "error".
+type apiError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+	// RequestID is also the X-Request-ID header, to find the request in
+	// the logs.
+	RequestID string `json:"requestId"`
+}
+
+// abortWithError answers the request with the error envelope.
+func abortWithError(c *gin.Context, status int, code string, message string, details interface{}) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"error": apiError{
+			Code:      code,
+			Message:   message,
+			Details:   details,
+			RequestID: c.GetString(requestIDKey),
+		},
+	})
+}
+
+// errorStatus tells the status and code an error calls for, fallback and
+// codeFor(fallback) when it is none the API knows about.
+func errorStatus(err error, fallback int) (int, string) {
+	var validationErr validation.Error
+	var validationErrs validation.Errors
+	var held *app_registry.LockHeldError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound), errors.Is(err, jobs.ErrJobNotFound):
+		return http.StatusNotFound, codeNotFound
+	case errors.Is(err, app_registry.ErrAlreadyExists):
+		return http.StatusConflict, codeAlreadyExists
+	case errors.As(err, &held), errors.Is(err, app_registry.ErrAppLocked):
+		return http.StatusConflict, codeAppLocked
+	case errors.Is(err, errPlanOutdated), errors.Is(err, app_registry.ErrRevisionChanged):
+		return http.StatusConflict, codePlanOutdated
+	case errors.Is(err, signing.ErrUnsigned),
+		errors.Is(err, signing.ErrUnknownKey),
+		errors.Is(err, signing.ErrBadSignature):
+		return http.StatusUnprocessableEntity, codeInvalidSignature
+	case errors.As(err, &validationErr), errors.As(err, &validationErrs),
+		errors.Is(err, app_registry.ErrAppNotValid),
+		errors.Is(err, app_registry.ErrUnknownHealPolicy),
+		errors.Is(err, app_registry.ErrUnknownScope),
+		errors.Is(err, app_registry.ErrUnknownPermission),
+		errors.Is(err, app_registry.ErrBadSelector),
+		errors.Is(err, app_compose.ErrUnsupportedKey),
+		errors.Is(err, app_compose.ErrDependencyCycle),
+		errors.Is(err, utils.ErrEmptyBundle),
+		errors.Is(err, utils.ErrUnexpectedImage),
+		errors.Is(err, utils.ErrUntaggedImage),
+		errors.Is(err, delta.ErrBadFormat):
+		return http.StatusUnprocessableEntity, codeInvalid
+	}
+	if status, code, ok := dockerErrorStatus(err); ok {
+		return status, code
+	}
+	var upstream upstreamError
+	if errors.As(err, &upstream) {
+		return http.StatusBadGateway, codeUpstreamError
+	}
+	return fallback, codeFor(fallback)
+}
+
+// upstreamError marks a failure of the Docker engine errdefs cannot tell
+// apart, a broken stream or a TLS error, so that it is answered 502 whatever
+// the fallback of the handler.
+type upstreamError struct {
+	err error
+}
+
+func (e upstreamError) Error() string { return e.err.Error() }
+func (e upstreamError) Unwrap() error { return e.err }
+
+// dockerErrorStatus maps the errors of the Docker engine. Other than
+// missing or conflicting objects they are failures of the engine, which is
+// the upstream of the API.
+func dockerErrorStatus(err error) (int, string, bool) {
+	if client.IsErrConnectionFailed(err) {
+		return http.StatusBadGateway, codeUpstreamError, true
+	}
+	// errdefs does not unwrap errors wrapped with %w
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		switch {
+		case errdefs.IsNotFound(e):
+			return http.StatusNotFound, codeDockerNotFound, true
+		case errdefs.IsConflict(e):
+			return http.StatusConflict, codeDockerConflict, true
+		case errdefs.IsInvalidParameter(e):
+			return http.StatusUnprocessableEntity, codeInvalid, true
+		case errdefs.IsSystem(e), errdefs.IsUnavailable(e), errdefs.IsUnknown(e),
+			errdefs.IsUnauthorized(e), errdefs.IsForbidden(e), errdefs.IsNotImplemented(e),
+			errdefs.IsDeadline(e), errdefs.IsDataLoss(e):
+			return http.StatusBadGateway, codeUpstreamError, true
+		}
+	}
+	return 0, "", false
+}
+
+func codeFor(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeBadRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusUnprocessableEntity:
+		return codeInvalid
+	case http.StatusBadGateway:
+		return codeUpstreamError
+	default:
+		return codeInternal
+	}
+}
+
+// respondError answers with the status the error calls for, fallback if it
+// is not a known one: http.StatusInternalServerError for failures of the
+// server, http.StatusBadGateway for failures of the Docker engine,
+// http.StatusUnprocessableEntity for errors about what the request holds.
+func respondError(c *gin.Context, fallback int, err error) {
+	status, code := errorStatus(err, fallback)
+	var details interface{}
+	var validationErrs validation.Errors
+	if errors.As(err, &validationErrs) {
+		details = validationErrs
+	}
+	if status >= http.StatusInternalServerError {
+		logging.Errorf("request %s: %s", c.GetString(requestIDKey), err)
+	}
+	abortWithError(c, status, code, err.Error(), details)
+}
+
+// badRequest answers 400 for a request that cannot be read.
+func badRequest(c *gin.Context, err error) {
+	abortWithError(c, http.StatusBadRequest, codeBadRequest, err.Error(), nil)
+}
+
+// idParam reads a numeric path parameter, answering the request if it is
+// not one.
+func idParam(c *gin.Context, name string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 32)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, codeBadRequest,
+			fmt.Sprintf("invalid %s '%s'", name, c.Param(name)), gin.H{"param": name})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// bindJSON reads the JSON body into obj, answering 400 if it is not JSON
+// of that shape and 422 with the fields at fault if it fails validation.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		badRequest(c, err)
+		return false
+	}
+	fields := gin.H{}
+	for _, fieldErr := range fieldErrs {
+		fields[fieldErr.Field()] = fieldErr.Tag()
+	}
+	abortWithError(c, http.StatusUnprocessableEntity, codeInvalid, err.Error(), gin.H{"fields": fields})
+	return false
+}
+
+const (
+	requestIDKey    = "requestId"
+	requestIDHeader = "X-Request-ID"
+)
+
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
+
+// requestID tags the request with the X-Request-ID the client sent, a new
+// one if it sent none, and sends it back.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 12)
+			if _, err := rand.Read(b); err != nil {
+				abortWithError(c, http.StatusInternalServerError, codeInternal, err.Error(), nil)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// recovered answers 500 for a handler that panicked, the panic is logged
+// by gin.
+func recovered(c *gin.Context, _ interface{}) {
+	abortWithError(c, http.StatusInternalServerError, codeInternal, "internal server error", nil)
+}
+
+func noRoute(c *gin.Context) {
+	abortWithError(c, http.StatusNotFound, codeNotFound,
+		fmt.Sprintf("no route %s %s", c.Request.Method, c.Request.URL.Path), nil)
+}
+
+func noMethod(c *gin.Context) {
+	abortWithError(c, http.StatusMethodNotAllowed, codeMethodNotAllowed,
+		fmt.Sprintf("method %s not allowed on %s", c.Request.Method, c.Request.URL.Path), nil)
+}
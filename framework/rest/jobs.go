@@ -0,0 +1,81 @@
+package framework_rest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	"github.com/gin-gonic/gin"
+)
+
+// jobSubmitError answers 409 with the operation holding the app when the
+// job could not be submitted because of it.
+func jobSubmitError(c *gin.Context, err error) {
+	var held *app_registry.LockHeldError
+	if errors.As(err, &held) {
+		abortWithError(c, http.StatusConflict, codeAppLocked, err.Error(), gin.H{
+			"lock": held.Lock,
+			"job":  apiPrefix + "/jobs/" + held.Lock.Holder,
+		})
+		return
+	}
+	respondError(c, http.StatusInternalServerError, err)
+}
+
+// getJob returns the job of the :id parameter if the principal may read
+// its app, answering the request otherwise. Jobs of no app, image pulls,
+// need the permission to pull images.
+func getJob(c *gin.Context, reg *app_registry.AppRegistry, manager *jobs.Manager) (*jobs.Job, bool) {
+	job, err := manager.Get(c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return nil, false
+	}
+	appID := job.View().AppID
+	if appID == 0 {
+		return job, authorizeApp(c, app_registry.PermImagesPull, nil)
+	}
+	app, err := reg.GetAppByIDWithDeleted(appID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return job, authorizeApp(c, app_registry.PermAppsRead, app)
+}
+
+func jobGet(reg *app_registry.AppRegistry, manager *jobs.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		job, ok := getJob(c, reg, manager)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, job.View())
+	}
+}
+
+// jobStream sends the job steps as server-sent events while it runs, then
+// the final state of the job as a "done" event.
+func jobStream(reg *app_registry.AppRegistry, manager *jobs.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		job, ok := getJob(c, reg, manager)
+		if !ok {
+			return
+		}
+
+		seen := 0
+		c.Stream(func(w io.Writer) bool {
+			view := job.Wait(c.Request.Context(), seen)
+			for _, step := range view.Steps[seen:] {
+				c.SSEvent("step", step)
+			}
+			seen = len(view.Steps)
+			if view.Done() {
+				c.SSEvent("done", view)
+				return false
+			}
+			return c.Request.Context().Err() == nil
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package framework_rest
+
+import (
+	"net/http"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/gin-gonic/gin"
+)
+
+func registryListCredentials(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		creds, err := reg.ListRegistryCredentials()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, creds)
+	}
+}
+
+func registrySetCredential(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Username string `json:"username" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		cred := &app_registry.RegistryCredential{
+			Registry: c.Param("registry"),
+			Username: body.Username,
+			Password: body.Password,
+		}
+		if err := reg.SetRegistryCredential(cred); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"registry": cred.Registry,
+			"username": cred.Username,
+		})
+	}
+}
+
+func registryRemoveCredential(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := reg.RemoveRegistryCredential(c.Param("registry")); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"registry": c.Param("registry"),
+		})
+	}
+}
@@ -1,18 +1,153 @@
 package framework_rest
 
 import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"time"
+
 	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	"github.com/beowulf20/docker-delta-update-server/framework/logging"
+	"github.com/beowulf20/docker-delta-update-server/framework/reconciler"
+	"github.com/beowulf20/docker-delta-update-server/framework/signing"
 	"github.com/docker/docker/client"
 	"github.com/gin-gonic/gin"
 )
 
-func NewRestServer(reg *app_registry.AppRegistry, cli *client.Client) error {
-	r := gin.Default()
-	r.GET("/reg/apps/all", appRegListAll(reg))
-	r.GET("/reg/app/:id", appParseApp(reg, cli))
-	r.POST("/reg/app/:id/stop", regStopApp(reg, cli))
-	r.POST("/reg/app/:id/start", regStartApp(reg, cli))
-	r.POST("/reg/app/:id/update", regUpdateApp(reg, cli))
-	r.POST("/reg/app/new", regNewApp(reg, cli))
-	return r.Run()
+// apiPrefix is the path every route of the API is under, the version
+// changing only with incompatible changes.
+const apiPrefix = "/api/v1"
+
+// Options are the settings of the REST server.
+type Options struct {
+	// TrustedKeys, when set, requires compose scripts, image bundles and
+	// pulled deltas to be signed by one of its keys.
+	TrustedKeys *signing.KeyRing
+	// Signer, when set, signs the image deltas served to other servers.
+	Signer *signing.Signer
+	// Addr is the address to listen on, ":8080" if empty.
+	Addr string
+	// TLS, when set, serves the API over TLS only.
+	TLS *TLSOptions
+	// Workers is the number of jobs run at once, 4 if 0.
+	Workers int
+	// RetainJobs is the number of finished jobs kept, 1000 if 0.
+	RetainJobs int
+	// LockLease is how long an app lock lasts unless renewed, a minute if 0.
+	LockLease time.Duration
+	// ReconcileInterval is the interval between two drift checks of every
+	// app. If 0 apps are only checked on demand.
+	ReconcileInterval time.Duration
+	// AccessLog logs every request.
+	AccessLog bool
+	// Upstreams are the update servers images may be pulled from as
+	// deltas, by name. No other server is ever contacted.
+	Upstreams map[string]Upstream
+}
+
+// Upstream is an update server at URL, reached with Client.
+type Upstream struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewRestServer(reg *app_registry.AppRegistry, cli *client.Client, opts Options) error {
+	var tlsConfig *tls.Config
+	if opts.TLS != nil {
+		var err error
+		tlsConfig, err = serverTLSConfig(opts.TLS)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Workers == 0 {
+		opts.Workers = 4
+	}
+	if opts.RetainJobs == 0 {
+		opts.RetainJobs = 1000
+	}
+	if opts.LockLease == 0 {
+		opts.LockLease = time.Minute
+	}
+	manager := jobs.NewManager(opts.Workers, opts.RetainJobs, app_registry.NewAppLocker(reg, opts.LockLease))
+	rec := reconciler.New(reg, cli, manager, opts.ReconcileInterval)
+	if opts.ReconcileInterval > 0 {
+		go rec.Run(context.Background())
+	}
+
+	server := &http.Server{
+		Addr:      opts.Addr,
+		Handler:   newRouter(reg, cli, manager, rec, opts),
+		TLSConfig: tlsConfig,
+	}
+	if server.Addr == "" {
+		server.Addr = ":8080"
+	}
+	if tlsConfig == nil {
+		logging.Infof("listening on %s", server.Addr)
+		return server.ListenAndServe()
+	}
+	logging.Infof("listening on %s with TLS", server.Addr)
+	// the certificate comes from TLSConfig, reloaded as it changes
+	return server.ListenAndServeTLS("", "")
+}
+
+// newRouter routes the API to its handlers, jobs run by manager.
+func newRouter(reg *app_registry.AppRegistry, cli *client.Client, manager *jobs.Manager, rec *reconciler.Reconciler, opts Options) *gin.Engine {
+	r := gin.New()
+	r.HandleMethodNotAllowed = true
+	r.Use(requestID())
+	if opts.AccessLog {
+		r.Use(gin.Logger())
+	}
+	r.Use(gin.CustomRecovery(recovered))
+	r.NoRoute(noRoute)
+	r.NoMethod(noMethod)
+
+	v1 := r.Group(apiPrefix, authenticate(reg))
+	v1.GET("/whoami", whoami)
+	v1.GET("/reg/apps/all", appRegListAll(reg))
+	v1.GET("/reg/apps/deleted", regListDeletedApps(reg))
+	v1.GET("/reg/app/:id", allowApp(reg, app_registry.PermAppsRead), appParseApp(reg, cli))
+	v1.DELETE("/reg/app/:id", allowApp(reg, app_registry.PermAppsDelete), regDeleteApp(reg, cli, manager))
+	v1.POST("/reg/app/:id/restore", allowApp(reg, app_registry.PermAppsDelete), regRestoreApp(reg, manager))
+	v1.POST("/reg/app/:id/stop", allowApp(reg, app_registry.PermAppsStop), regStopApp(reg, cli, manager))
+	v1.POST("/reg/app/:id/start", allowApp(reg, app_registry.PermAppsStart), regStartApp(reg, cli, manager))
+	v1.POST("/reg/app/:id/adopt", allowApp(reg, app_registry.PermAppsUpdate), regAdoptApp(reg, cli, manager))
+	v1.POST("/reg/app/:id/plan", allowApp(reg, app_registry.PermAppsRead), regPlanApp(reg, cli))
+	v1.POST("/reg/app/:id/update", allowApp(reg, app_registry.PermAppsUpdate), regUpdateApp(reg, cli, manager, opts.TrustedKeys))
+	v1.POST("/reg/app/:id/bundle", allowApp(reg, app_registry.PermAppsUpdate), regUploadBundle(reg, cli, manager, opts.TrustedKeys))
+	v1.GET("/reg/app/:id/revisions", allowApp(reg, app_registry.PermAppsRead), regListRevisions(reg))
+	v1.GET("/reg/app/:id/revisions/diff", allowApp(reg, app_registry.PermAppsRead), regDiffRevisions(reg))
+	v1.GET("/reg/app/:id/revisions/:rev", allowApp(reg, app_registry.PermAppsRead), regGetRevision(reg))
+	v1.POST("/reg/app/:id/rollback/:rev", allowApp(reg, app_registry.PermAppsUpdate), regRollbackApp(reg, cli, manager, opts.TrustedKeys))
+	v1.GET("/reg/app/:id/drift", allowApp(reg, app_registry.PermAppsRead), regAppDrift(reg, rec))
+	v1.POST("/reg/app/:id/heal", allowApp(reg, app_registry.PermAppsStart), regHealApp(reg, rec))
+	v1.PUT("/reg/app/:id/heal-policy", allowApp(reg, app_registry.PermAppsConfigure), regSetHealPolicy(reg))
+	v1.PUT("/reg/app/:id/labels", allowGlobal(app_registry.PermAccessManage), regSetAppLabels(reg))
+	v1.GET("/reg/drift", driftListAll(reg, rec))
+	v1.POST("/reg/app/new", regNewApp(reg, cli, opts.TrustedKeys))
+	v1.GET("/registries", allowGlobal(app_registry.PermRegistriesManage), registryListCredentials(reg))
+	v1.PUT("/registries/:registry", allowGlobal(app_registry.PermRegistriesManage), registrySetCredential(reg))
+	v1.DELETE("/registries/:registry", allowGlobal(app_registry.PermRegistriesManage), registryRemoveCredential(reg))
+	v1.GET("/tokens", allowGlobal(app_registry.PermAccessManage), tokenList(reg))
+	v1.POST("/tokens", allowGlobal(app_registry.PermAccessManage), tokenCreate(reg))
+	v1.DELETE("/tokens/:id", allowGlobal(app_registry.PermAccessManage), tokenRevoke(reg))
+	v1.GET("/users", allowGlobal(app_registry.PermAccessManage), userList(reg))
+	v1.POST("/users", allowGlobal(app_registry.PermAccessManage), userCreate(reg))
+	v1.DELETE("/users/:id", allowGlobal(app_registry.PermAccessManage), userRemove(reg))
+	v1.GET("/roles", allowGlobal(app_registry.PermAccessManage), roleList(reg))
+	v1.PUT("/roles/:name", allowGlobal(app_registry.PermAccessManage), roleSet(reg))
+	v1.DELETE("/roles/:name", allowGlobal(app_registry.PermAccessManage), roleRemove(reg))
+	v1.GET("/bindings", allowGlobal(app_registry.PermAccessManage), bindingList(reg))
+	v1.POST("/bindings", allowGlobal(app_registry.PermAccessManage), bindingCreate(reg))
+	v1.DELETE("/bindings/:id", allowGlobal(app_registry.PermAccessManage), bindingRemove(reg))
+	v1.GET("/delta/images/signature", allowGlobal(app_registry.PermImagesRead), deltaImageSignature(cli))
+	v1.POST("/delta/images/delta", allowGlobal(app_registry.PermImagesRead), deltaImageDelta(cli, opts.Signer))
+	v1.POST("/delta/images/pull", allowGlobal(app_registry.PermImagesPull), deltaImagePull(cli, manager, opts.Upstreams, opts.TrustedKeys))
+	v1.GET("/jobs/:id", jobGet(reg, manager))
+	v1.GET("/jobs/:id/stream", jobStream(reg, manager))
+	return r
 }
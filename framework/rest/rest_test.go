@@ -0,0 +1,243 @@
+package framework_rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/jobs"
+	"github.com/beowulf20/docker-delta-update-server/framework/reconciler"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type testServer struct {
+	router *gin.Engine
+	reg    *app_registry.AppRegistry
+	locker *app_registry.AppLocker
+	// admin is the secret of a token allowed everything
+	admin string
+}
+
+// newTestServer routes the API over an in-memory registry. Its Docker
+// engine cannot be reached, every call to it fails.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	reg, err := app_registry.NewAppRegistryWithLogger(app_registry.DriverSQLite, ":memory:", logger.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locker := app_registry.NewAppLocker(reg, time.Minute)
+	manager := jobs.NewManager(1, 10, locker)
+	rec := reconciler.New(reg, cli, manager, 0)
+
+	_, admin, err := reg.CreateToken("admin", app_registry.ScopeAdmin, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{
+		router: newRouter(reg, cli, manager, rec, Options{}),
+		reg:    reg,
+		locker: locker,
+		admin:  admin,
+	}
+}
+
+func (s *testServer) addApp(t *testing.T, name string) *app_registry.App {
+	t.Helper()
+	app, err := app_registry.NewApp(name, "services:\n  web:\n    image: nginx\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reg.AddApp(app, app_registry.RevisionInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func (s *testServer) token(t *testing.T, scope app_registry.TokenScope, apps ...string) string {
+	t.Helper()
+	_, secret, err := s.reg.CreateToken("test", scope, apps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// do sends the request with the token and returns the answer, with its
+// error if it is one.
+func (s *testServer) do(t *testing.T, secret string, method string, path string, body string) (*httptest.ResponseRecorder, apiError) {
+	t.Helper()
+	req := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+
+	var answer struct {
+		Error apiError `json:"error"`
+	}
+	if w.Code >= http.StatusBadRequest {
+		if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+			t.Fatalf("%s %s: error body %q: %s", method, path, w.Body.String(), err)
+		}
+	}
+	return w, answer.Error
+}
+
+func TestErrorAnswers(t *testing.T) {
+	s := newTestServer(t)
+	app := s.addApp(t, "web")
+	read := s.token(t, app_registry.ScopeRead)
+	if err := s.locker.Lock(app.ID, "other", "update", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.reg.CreateUser("ops"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"no token", "", http.MethodGet, "/whoami", "", http.StatusUnauthorized, codeUnauthorized},
+		{"bad id", s.admin, http.MethodGet, "/reg/app/web", "", http.StatusBadRequest, codeBadRequest},
+		{"unknown app", s.admin, http.MethodGet, "/reg/app/999", "", http.StatusNotFound, codeNotFound},
+		{"unknown job", s.admin, http.MethodGet, "/jobs/none", "", http.StatusNotFound, codeNotFound},
+		{"no route", s.admin, http.MethodGet, "/none", "", http.StatusNotFound, codeNotFound},
+		{"existing user", s.admin, http.MethodPost, "/users", `{"name":"ops"}`, http.StatusConflict, codeAlreadyExists},
+		{"locked app", s.admin, http.MethodPost, fmt.Sprintf("/reg/app/%d/stop", app.ID), "", http.StatusConflict, codeAppLocked},
+		{"docker unreachable", s.admin, http.MethodGet, fmt.Sprintf("/reg/app/%d", app.ID), "", http.StatusBadGateway, codeUpstreamError},
+		{"scope too low", read, http.MethodPost, fmt.Sprintf("/reg/app/%d/stop", app.ID), "", http.StatusForbidden, codeForbidden},
+		{"invalid body", s.admin, http.MethodPost, "/users", `{}`, http.StatusUnprocessableEntity, codeInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, apiErr := s.do(t, test.secret, test.method, test.path, test.body)
+			if w.Code != test.status || apiErr.Code != test.code {
+				t.Errorf("answered %d %q, want %d %q: %s", w.Code, apiErr.Code, test.status, test.code, w.Body.String())
+			}
+			if apiErr.RequestID == "" || apiErr.RequestID != w.Header().Get(requestIDHeader) {
+				t.Errorf("request ID %q, header %q", apiErr.RequestID, w.Header().Get(requestIDHeader))
+			}
+		})
+	}
+}
+
+func TestRespondError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		fallback int
+		status   int
+		code     string
+	}{
+		{"record not found", fmt.Errorf("app 1: %w", gorm.ErrRecordNotFound), http.StatusInternalServerError, http.StatusNotFound, codeNotFound},
+		{"already exists", app_registry.ErrAlreadyExists, http.StatusInternalServerError, http.StatusConflict, codeAlreadyExists},
+		{"conflict", errors.New("conflicting"), http.StatusConflict, http.StatusConflict, codeConflict},
+		{"lock held", &app_registry.LockHeldError{}, http.StatusInternalServerError, http.StatusConflict, codeAppLocked},
+		{"plan outdated", errPlanOutdated, http.StatusInternalServerError, http.StatusConflict, codePlanOutdated},
+		{"revision changed", fmt.Errorf("update: %w", app_registry.ErrRevisionChanged), http.StatusInternalServerError, http.StatusConflict, codePlanOutdated},
+		{"docker not found", fmt.Errorf("inspect: %w", errdefs.NotFound(errors.New("no such container"))), http.StatusInternalServerError, http.StatusNotFound, codeDockerNotFound},
+		{"docker conflict", errdefs.Conflict(errors.New("name in use")), http.StatusInternalServerError, http.StatusConflict, codeDockerConflict},
+		{"docker failure", errdefs.System(errors.New("disk full")), http.StatusInternalServerError, http.StatusBadGateway, codeUpstreamError},
+		{"upstream", upstreamError{errors.New("broken stream")}, http.StatusInternalServerError, http.StatusBadGateway, codeUpstreamError},
+		{"unknown", errors.New("failed"), http.StatusInternalServerError, http.StatusInternalServerError, codeInternal},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/", func(c *gin.Context) {
+				respondError(c, test.fallback, test.err)
+			})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			var answer struct {
+				Error apiError `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != test.status || answer.Error.Code != test.code {
+				t.Errorf("answered %d %q, want %d %q", w.Code, answer.Error.Code, test.status, test.code)
+			}
+			if answer.Error.Message != test.err.Error() {
+				t.Errorf("message %q, want %q", answer.Error.Message, test.err.Error())
+			}
+		})
+	}
+}
+
+func TestAllowAppRestrictedToken(t *testing.T) {
+	s := newTestServer(t)
+	web := s.addApp(t, "web")
+	other := s.addApp(t, "other")
+	restricted := s.token(t, app_registry.ScopeRead, "web")
+
+	tests := []struct {
+		name   string
+		secret string
+		path   string
+		status int
+		code   string
+	}{
+		{"its app", restricted, fmt.Sprintf("/reg/app/%d/revisions", web.ID), http.StatusOK, ""},
+		{"another app", restricted, fmt.Sprintf("/reg/app/%d/revisions", other.ID), http.StatusForbidden, codeForbidden},
+		// whether the app exists is none of its business
+		{"unknown app", restricted, "/reg/app/999/revisions", http.StatusForbidden, codeForbidden},
+		{"unknown app, unrestricted", s.admin, "/reg/app/999/revisions", http.StatusNotFound, codeNotFound},
+		{"global permission", restricted, "/registries", http.StatusForbidden, codeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, apiErr := s.do(t, test.secret, http.MethodGet, test.path, "")
+			if w.Code != test.status || apiErr.Code != test.code {
+				t.Errorf("answered %d %q, want %d %q: %s", w.Code, apiErr.Code, test.status, test.code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPrincipalName(t *testing.T) {
+	token := &app_registry.ApiToken{Name: "ci", Model: gorm.Model{ID: 3}}
+	user := &app_registry.Grants{User: app_registry.User{Name: "ops"}}
+	tests := []struct {
+		name      string
+		principal principal
+		want      string
+	}{
+		{"token", principal{token: token}, "token 'ci' #3"},
+		{"token of a user", principal{token: token, grants: user}, "ops (token 'ci' #3)"},
+		{"certificate", principal{certificate: "ops", grants: user}, "ops"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.principal.name(); got != test.want {
+				t.Errorf("name = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package framework_rest
+
+import (
+	"fmt"
+	"net/http"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/signing"
+	"github.com/gin-gonic/gin"
+)
+
+// verifySignature checks the signature of a payload when keys are trusted,
+// answering the request if it does not hold. It returns the id of the
+// signing key.
+func verifySignature(c *gin.Context, keys *signing.KeyRing, what string, digest []byte, signature string) (string, bool) {
+	keyID, err := keys.Verify(digest, signature)
+	if err != nil {
+		respondError(c, http.StatusUnprocessableEntity, fmt.Errorf("%s: %w", what, err))
+		return "", false
+	}
+	return keyID, true
+}
+
+// verifyScript checks the signature header of a compose script sent as the
+// request body.
+func verifyScript(c *gin.Context, keys *signing.KeyRing, script []byte) (string, bool) {
+	return verifySignature(c, keys, "compose script", signing.Digest(script), c.GetHeader(signing.Header))
+}
+
+// revisionSigner is the key the current compose script of the app was
+// signed with.
+func revisionSigner(reg *app_registry.AppRegistry, app *app_registry.App) (string, error) {
+	rev, err := reg.GetRevision(app.ID, app.Revision)
+	if err != nil {
+		return "", err
+	}
+	return rev.SignedBy, nil
+}
@@ -0,0 +1,219 @@
+package framework_rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/beowulf20/docker-delta-update-server/framework/logging"
+)
+
+// TLSOptions serve the API over TLS.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, when set, asks clients for a certificate signed by one
+	// of its CAs. A client without a bearer token is then identified by the
+	// common name of its certificate, as the registry user of that name.
+	ClientCAFile string
+	// RequireClientCert refuses clients without such a certificate.
+	RequireClientCert bool
+	// SelfSigned creates a self-signed certificate for Hosts in CertFile
+	// and KeyFile when they do not exist yet, for a first setup.
+	SelfSigned bool
+	Hosts      []string
+}
+
+// certReloadInterval is how often the certificate files are checked for
+// changes, at most, on new connections.
+var certReloadInterval = 5 * time.Second
+
+// certReloader serves the certificate of its files and reloads it when they
+// change, so a renewed certificate is used without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetCertificate is the tls.Config hook. A certificate that fails to load,
+// half written for instance, leaves the previous one in use.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) >= certReloadInterval {
+		r.checkedAt = time.Now()
+		modTime, err := r.filesModTime()
+		if err == nil && !modTime.Equal(r.modTime) {
+			err = r.load(modTime)
+			if err == nil {
+				logging.Infof("reloaded TLS certificate %s", r.certFile)
+			}
+		}
+		if err != nil {
+			logging.Errorf("reloading TLS certificate %s: %s", r.certFile, err)
+		}
+	}
+	return r.cert, nil
+}
+
+// serverTLSConfig builds the TLS configuration of the server.
+func serverTLSConfig(opts *TLSOptions) (*tls.Config, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("TLS needs a certificate and a key file")
+	}
+	if opts.SelfSigned {
+		if err := ensureSelfSigned(opts.CertFile, opts.KeyFile, opts.Hosts); err != nil {
+			return nil, err
+		}
+	}
+	reloader, err := newCertReloader(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if opts.ClientCAFile != "" {
+		pemCerts, err := ioutil.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("%s holds no PEM certificate", opts.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if opts.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if opts.RequireClientCert {
+		return nil, errors.New("requiring client certificates needs a client CA file")
+	}
+	return cfg, nil
+}
+
+// ensureSelfSigned writes a self-signed certificate for the hosts, and its
+// key, unless the certificate file exists already. The fingerprint is
+// logged for clients to pin it.
+func ensureSelfSigned(certFile string, keyFile string, hosts []string) error {
+	if _, err := os.Stat(certFile); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if name, err := os.Hostname(); err == nil {
+			hosts = append(hosts, name)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"docker-delta-update-server"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+	}
+	// the key first: a certificate without its key would not be replaced
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(der)
+	logging.Infof("created self-signed TLS certificate %s for %v, SHA-256 fingerprint %s", certFile, hosts, hex.EncodeToString(sum[:]))
+	return nil
+}
@@ -0,0 +1,77 @@
+package framework_rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func tokenList(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		tokens, err := reg.ListTokens()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// tokenCreate answers with the new token and its secret, which cannot be
+// read again afterwards. A token given a user acts with its permissions.
+func tokenCreate(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			Name  string                  `json:"name" binding:"required"`
+			Scope app_registry.TokenScope `json:"scope" binding:"required"`
+			Apps  []string                `json:"apps"`
+			User  string                  `json:"user"`
+		}
+		if !bindJSON(c, &body) {
+			return
+		}
+		var user *app_registry.User
+		if body.User != "" {
+			var err error
+			user, err = reg.GetUserByName(body.User)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				abortWithError(c, http.StatusUnprocessableEntity, codeInvalid,
+					fmt.Sprintf("no user '%s'", body.User), gin.H{"fields": gin.H{"User": "exists"}})
+				return
+			}
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		token, secret, err := reg.CreateToken(body.Name, body.Scope, body.Apps, user)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"token":  token,
+			"secret": secret,
+		})
+	}
+}
+
+func tokenRevoke(reg *app_registry.AppRegistry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, ok := idParam(c, "id")
+		if !ok {
+			return
+		}
+		if err := reg.RevokeToken(id); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id": id,
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package signing
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A signature is detached: it is sent next to the payload, as
+// "<key id>:<base64 signature>". What is signed is not the payload itself but
+// its SHA-256 digest, so large bundles and deltas are signed and verified
+// while they stream, without holding them in memory. The digest of a delta
+// also covers the images it goes from and to, see delta.NewDigest.
+
+var (
+	ErrUnsigned     = errors.New("payload is not signed")
+	ErrUnknownKey   = errors.New("signing key is not trusted")
+	ErrBadSignature = errors.New("signature does not match")
+)
+
+// Header carries the signature of a request or response body.
+const Header = "X-Signature"
+
+func Digest(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	return sum[:]
+}
+
+// parseSignature splits a signature into its key id and its bytes.
+func parseSignature(signature string) (string, []byte, error) {
+	i := strings.LastIndexByte(signature, ':')
+	if i <= 0 {
+		return "", nil, fmt.Errorf("%w: expected <key id>:<base64 signature>", ErrBadSignature)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature[i+1:]))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return "", nil, fmt.Errorf("%w: malformed signature", ErrBadSignature)
+	}
+	return signature[:i], sig, nil
+}
+
+// KeyRing holds the keys whose signatures are accepted. A nil KeyRing
+// verifies nothing: signatures are only required once keys are trusted.
+type KeyRing struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// LoadKeyRing reads trusted keys from a file with one "<key id> <base64
+// public key>" per line. Blank lines and lines starting with # are skipped.
+func LoadKeyRing(path string) (*KeyRing, error) {
+	ring := &KeyRing{keys: map[string]ed25519.PublicKey{}}
+	err := readKeyFile(path, func(id string, key []byte) error {
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("key '%s' is not an ed25519 public key", id)
+		}
+		if _, ok := ring.keys[id]; ok {
+			return fmt.Errorf("key '%s' is listed twice", id)
+		}
+		ring.keys[id] = ed25519.PublicKey(key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("%s lists no key", path)
+	}
+	return ring, nil
+}
+
+// Required tells whether payloads must be signed.
+func (ring *KeyRing) Required() bool {
+	return ring != nil
+}
+
+// Verify checks the signature of the payload with the given digest and
+// returns the id of the key that made it. With a nil KeyRing it returns an
+// empty id and no error.
+func (ring *KeyRing) Verify(digest []byte, signature string) (string, error) {
+	if ring == nil {
+		return "", nil
+	}
+	if signature == "" {
+		return "", ErrUnsigned
+	}
+	id, sig, err := parseSignature(signature)
+	if err != nil {
+		return "", err
+	}
+	key, ok := ring.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: '%s'", ErrUnknownKey, id)
+	}
+	if !ed25519.Verify(key, digest, sig) {
+		return "", fmt.Errorf("%w: key '%s'", ErrBadSignature, id)
+	}
+	return id, nil
+}
+
+// Signer signs what this server produces for others, image deltas.
+type Signer struct {
+	ID  string
+	key ed25519.PrivateKey
+}
+
+// LoadSigner reads a key file like LoadKeyRing's holding one private key,
+// either its 32 bytes seed or the whole 64 bytes key.
+func LoadSigner(path string) (*Signer, error) {
+	var signer *Signer
+	err := readKeyFile(path, func(id string, key []byte) error {
+		if signer != nil {
+			return errors.New("more than one signing key")
+		}
+		switch len(key) {
+		case ed25519.SeedSize:
+			key = ed25519.NewKeyFromSeed(key)
+		case ed25519.PrivateKeySize:
+		default:
+			return fmt.Errorf("key '%s' is not an ed25519 private key", id)
+		}
+		signer = &Signer{ID: id, key: ed25519.PrivateKey(key)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("%s holds no key", path)
+	}
+	return signer, nil
+}
+
+// Sign returns the signature of the payload with the given digest.
+func (s *Signer) Sign(digest []byte) string {
+	return s.ID + ":" + base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, digest))
+}
+
+func readKeyFile(path string, add func(id string, key []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected <key id> <base64 key>", path, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if err := add(fields[0], key); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
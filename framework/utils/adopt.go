@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// LegacyContainers returns the containers of the app created before
+// ownership labels existed: named like one of its replicas and carrying no
+// owner. AssociateContainerApp does not see them until they are adopted
+// with AdoptContainers. The keys are the replica names.
+func LegacyContainers(ctx context.Context, cli *client.Client, app app_registry.App) (map[string]types.Container, error) {
+	project, err := compose.LoadDockerCompose([]byte(app.ComposeScript), app.Name)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, service := range project.AllServices() {
+		for _, name := range compose.ReplicaNames(project.Name, service) {
+			names[name] = true
+		}
+	}
+
+	conts, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	legacy := map[string]types.Container{}
+	for _, cont := range conts {
+		if _, owned := cont.Labels[compose.LabelAppID]; owned {
+			continue
+		}
+		for _, name := range cont.Names {
+			if len(name) > 1 && names[name[1:]] {
+				legacy[name[1:]] = cont
+			}
+		}
+	}
+	return legacy, nil
+}
+
+// AdoptContainers takes ownership of the legacy containers of the app, in
+// dependency order. Docker cannot add labels to a container, so each one is
+// replaced by a labeled container created from its service, left running
+// or stopped as the legacy one was. Named volumes are kept, anonymous ones
+// are not. If a replacement fails the legacy container is put back. It
+// returns the names of the adopted containers.
+func AdoptContainers(ctx context.Context, cli *client.Client, app app_registry.App, auth RegistryAuth, progress Progress) ([]string, error) {
+	legacy, err := LegacyContainers(ctx, cli, app)
+	if err != nil {
+		return nil, err
+	}
+	adopted := []string{}
+	if len(legacy) == 0 {
+		return adopted, nil
+	}
+
+	project, err := compose.LoadDockerCompose([]byte(app.ComposeScript), app.Name)
+	if err != nil {
+		return nil, err
+	}
+	order, err := compose.ServiceStartOrder(project)
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, name := range order {
+		service, err := project.GetService(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, contName := range compose.ReplicaNames(project.Name, service) {
+			if _, ok := legacy[contName]; ok {
+				services = append(services, name)
+				break
+			}
+		}
+	}
+	if err := EnsureAppResources(ctx, cli, project); err != nil {
+		return nil, err
+	}
+	if err := EnsureServiceImages(ctx, cli, project, services, auth, progress); err != nil {
+		return nil, err
+	}
+
+	for _, name := range services {
+		service, err := project.GetService(name)
+		if err != nil {
+			return nil, err
+		}
+		for i, contName := range compose.ReplicaNames(project.Name, service) {
+			cont, ok := legacy[contName]
+			if !ok {
+				continue
+			}
+			err := adoptContainer(ctx, cli, AppOwner(app), project, service, i+1, cont)
+			if err != nil {
+				return adopted, fmt.Errorf("adopting %s: %w", contName, err)
+			}
+			progress.report("adopted %s", contName)
+			adopted = append(adopted, contName)
+		}
+	}
+	return adopted, nil
+}
+
+func adoptContainer(ctx context.Context, cli *client.Client, owner Owner, project *ctypes.Project, service ctypes.ServiceConfig, replica int, legacy types.Container) error {
+	opts, err := serviceOptions(owner, project, service, replica)
+	if err != nil {
+		return err
+	}
+	running := legacy.State == "running"
+
+	renamed := false
+	id := ""
+	rollback := func(err error) error {
+		// the rollback must happen even if the request is gone
+		ctx := context.Background()
+		if id != "" {
+			cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+		}
+		if renamed {
+			cli.ContainerRename(ctx, legacy.ID, opts.Name)
+		}
+		if running {
+			cli.ContainerStart(ctx, legacy.ID, types.ContainerStartOptions{})
+		}
+		return err
+	}
+
+	if running {
+		if err := cli.ContainerStop(ctx, legacy.ID, nil); err != nil {
+			return rollback(err)
+		}
+	}
+	if err := cli.ContainerRename(ctx, legacy.ID, opts.Name+"_legacy"); err != nil {
+		return rollback(err)
+	}
+	renamed = true
+	id, err = createContainer(ctx, cli, opts)
+	if err == nil && running {
+		err = cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
+	}
+	if err != nil {
+		return rollback(err)
+	}
+	return cli.ContainerRemove(ctx, legacy.ID, types.ContainerRemoveOptions{})
+}
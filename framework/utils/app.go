@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"context"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// Progress receives a line for every step of a long running operation.
+type Progress func(format string, args ...interface{})
+
+func (p Progress) report(format string, args ...interface{}) {
+	if p != nil {
+		p(format, args...)
+	}
+}
+
+// StartApp creates the missing containers of the app and starts every
+// container that is not running, in dependency order. Images are acquired
+// first, as the pull_policy of the services says.
+func StartApp(ctx context.Context, cli *client.Client, app app_registry.App, auth RegistryAuth, progress Progress) error {
+	project, err := compose.LoadDockerCompose([]byte(app.ComposeScript), app.Name)
+	if err != nil {
+		return err
+	}
+
+	err = EnsureAppResources(ctx, cli, project)
+	if err != nil {
+		return err
+	}
+
+	conts, err := AssociateContainerApp(app, cli)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, cont := range conts {
+		if cont.Status == ContainerNotCreated {
+			missing = append(missing, cont.Service.Name)
+		}
+	}
+	err = EnsureServiceImages(ctx, cli, project, missing, auth, progress)
+	if err != nil {
+		return err
+	}
+
+	for _, cont := range conts {
+		if cont.Status == ContainerRunning {
+			progress.report("%s already running", cont.Name)
+			continue
+		}
+		progress.report("waiting for dependencies of %s", cont.Name)
+		err = WaitForDependencies(ctx, cli, app.ID, project, cont.Service)
+		if err != nil {
+			return err
+		}
+		id := ""
+		if cont.Status == ContainerNotCreated {
+			id, err = CreateServiceContainer(ctx, cli, AppOwner(app), project, cont.Service, cont.Replica)
+			if err != nil {
+				return err
+			}
+			progress.report("created %s", cont.Name)
+		} else {
+			id = cont.Container.ID
+		}
+
+		err = cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
+		if err != nil {
+			return err
+		}
+		progress.report("started %s", cont.Name)
+	}
+	return nil
+}
+
+// StopApp stops the running containers of the app in reverse dependency
+// order.
+func StopApp(ctx context.Context, cli *client.Client, app app_registry.App, progress Progress) error {
+	conts, err := AssociateContainerApp(app, cli)
+	if err != nil {
+		return err
+	}
+
+	for i := len(conts) - 1; i >= 0; i-- {
+		cont := conts[i]
+		if cont.Status != ContainerRunning {
+			continue
+		}
+		err = cli.ContainerStop(ctx, cont.Container.ID, nil)
+		if err != nil {
+			return err
+		}
+		progress.report("stopped %s", cont.Name)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// BlueGreenTimeout is how long the new container of a blue-green service
+// gets to become healthy before the update gives up on it.
+var BlueGreenTimeout = 5 * time.Minute
+
+// BlueGreenReplace replaces the running container oldID of a blue-green
+// service without a gap. The new container is started next to the old one
+// under compose.BlueGreenName, attached to the service networks without its
+// aliases, so nothing is routed to it until it reports healthy. It then
+// takes over the aliases, the old container is stopped and moved to
+// compose.BlueGreenOldName, the new one is renamed to the service container
+// name and the old one is removed. If anything fails before the old
+// container is gone, the new one is removed and the old one is brought back
+// with its name and aliases, so the service is never left half-switched.
+func BlueGreenReplace(ctx context.Context, cli *client.Client, owner Owner, project *ctypes.Project, service ctypes.ServiceConfig, oldID string, progress Progress) error {
+	opts, err := serviceOptions(owner, project, service, 1)
+	if err != nil {
+		return err
+	}
+	name := opts.Name
+	oldName := compose.BlueGreenOldName(project.Name, service.Name)
+	endpoints := map[string]*network.EndpointSettings{}
+	for net, endpoint := range opts.NetworkingConfig.EndpointsConfig {
+		endpoints[net] = endpoint
+	}
+	for net, endpoint := range opts.ExtraNetworks {
+		endpoints[net] = endpoint
+	}
+
+	opts.Name = compose.BlueGreenName(project.Name, service.Name)
+	opts.NetworkingConfig = &network.NetworkingConfig{EndpointsConfig: withoutAliases(opts.NetworkingConfig.EndpointsConfig)}
+	opts.ExtraNetworks = withoutAliases(opts.ExtraNetworks)
+
+	// leftovers of an update that did not finish
+	for _, leftover := range []string{opts.Name, oldName} {
+		cont, err := cli.ContainerInspect(ctx, leftover)
+		switch {
+		case client.IsErrNotFound(err):
+			continue
+		case err != nil:
+			return err
+		case cont.Config == nil || cont.Config.Labels[compose.LabelAppID] != strconv.FormatUint(uint64(owner.AppID), 10):
+			// only the name tells it apart, it may not be ours to remove
+			err = fmt.Errorf("container '%s' is in the way and is not owned by the app", leftover)
+		case cont.ID == oldID:
+			// renamed but never removed, bring it back
+			err = cli.ContainerRename(ctx, oldID, name)
+		default:
+			err = cli.ContainerRemove(ctx, cont.ID, types.ContainerRemoveOptions{Force: true})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err := createContainer(ctx, cli, opts)
+	if err == nil {
+		err = cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
+	}
+	if err == nil {
+		progress.report("started %s next to the running container, waiting for it to be healthy", opts.Name)
+		waitCtx, cancel := context.WithTimeout(ctx, BlueGreenTimeout)
+		err = waitForCondition(waitCtx, cli, opts.Name, id, ctypes.ServiceConditionHealthy)
+		cancel()
+	}
+	if err != nil {
+		if id != "" {
+			cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+		}
+		return fmt.Errorf("new container of '%s' not ready, old container kept: %w", service.Name, err)
+	}
+
+	renamed := false
+	rollback := func(err error) error {
+		// the request may be gone, the rollback must still happen
+		ctx := context.Background()
+		cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+		if renamed {
+			cli.ContainerRename(ctx, oldID, name)
+		}
+		// starting the old container again reattaches it with its aliases,
+		// it is a no-op if it still runs
+		if startErr := cli.ContainerStart(ctx, oldID, types.ContainerStartOptions{}); startErr != nil {
+			return fmt.Errorf("switching '%s' to the new container: %w, restarting the old one: %s", service.Name, err, startErr)
+		}
+		progress.report("switching %s failed, old container restored", service.Name)
+		return fmt.Errorf("switching '%s' to the new container, old container restored: %w", service.Name, err)
+	}
+
+	var nets []string
+	for net := range endpoints {
+		nets = append(nets, net)
+	}
+	sort.Strings(nets)
+	for _, net := range nets {
+		err = cli.NetworkDisconnect(ctx, net, id, false)
+		if err != nil {
+			return rollback(err)
+		}
+		err = cli.NetworkConnect(ctx, net, id, endpoints[net])
+		if err != nil {
+			return rollback(err)
+		}
+	}
+	progress.report("switched %s aliases to %s", service.Name, opts.Name)
+
+	err = cli.ContainerStop(ctx, oldID, nil)
+	if err != nil {
+		return rollback(err)
+	}
+	err = cli.ContainerRename(ctx, oldID, oldName)
+	if err != nil {
+		return rollback(err)
+	}
+	renamed = true
+	err = cli.ContainerRename(ctx, id, name)
+	if err != nil {
+		return rollback(err)
+	}
+
+	// the new container serves under its name, a failure to remove the
+	// old one leaves a stopped container to clean up, not a broken service
+	err = cli.ContainerRemove(ctx, oldID, types.ContainerRemoveOptions{})
+	if err != nil {
+		progress.report("could not remove the old container %s: %s", oldName, err)
+	}
+	return nil
+}
+
+func withoutAliases(endpoints map[string]*network.EndpointSettings) map[string]*network.EndpointSettings {
+	stripped := map[string]*network.EndpointSettings{}
+	for net, endpoint := range endpoints {
+		e := *endpoint
+		e.Aliases = nil
+		stripped[net] = &e
+	}
+	return stripped
+}
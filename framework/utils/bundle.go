@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/client"
+)
+
+var (
+	ErrEmptyBundle     = errors.New("bundle contains no tagged image")
+	ErrUnexpectedImage = errors.New("image is not used by the app")
+	ErrUntaggedImage   = errors.New("bundle contains an untagged image")
+)
+
+// ImageBundle is a `docker save` tarball, plain or gzipped, kept in a
+// temporary file until it is loaded.
+type ImageBundle struct {
+	path string
+	// Images are the tags saved in the bundle, normalized.
+	Images []string `json:"images"`
+	// Untagged are the configs of the images saved without a tag, which
+	// nothing could tell belong to the app.
+	Untagged []string `json:"untagged,omitempty"`
+	// Digest is the SHA-256 of the bundle as uploaded.
+	Digest []byte `json:"-"`
+}
+
+// SaveImageBundle copies the bundle to a temporary file and reads the
+// images tagged in it from its manifest on the way. The bundle must be
+// closed once done with.
+func SaveImageBundle(r io.Reader) (*ImageBundle, error) {
+	f, err := ioutil.TempFile("", "image-bundle-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	bundle := &ImageBundle{path: f.Name()}
+	defer f.Close()
+
+	hasher := sha256.New()
+	w := io.MultiWriter(f, hasher)
+	images, untagged, err := bundleImages(io.TeeReader(r, w))
+	if err == nil {
+		// whatever follows the manifest still has to reach the file
+		_, err = io.Copy(w, r)
+	}
+	if err == nil && len(images) == 0 && len(untagged) == 0 {
+		err = ErrEmptyBundle
+	}
+	if err != nil {
+		bundle.Close()
+		return nil, err
+	}
+	bundle.Images = images
+	bundle.Untagged = untagged
+	bundle.Digest = hasher.Sum(nil)
+	return bundle, nil
+}
+
+func (b *ImageBundle) Close() error {
+	return os.Remove(b.path)
+}
+
+// bundleImages lists the tags of manifest.json, and the configs of the
+// images without any. The tarball is read to its end, so everything read
+// goes through to the caller's copy.
+func bundleImages(r io.Reader) ([]string, []string, error) {
+	buf := bufio.NewReader(r)
+	var archive io.Reader = buf
+	if magic, _ := buf.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		archive = gz
+	}
+
+	var images, untagged []string
+	found := false
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading bundle: %w", err)
+		}
+		if hdr.Name != "manifest.json" {
+			continue
+		}
+		var manifest []struct {
+			Config   string
+			RepoTags []string
+		}
+		if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+			return nil, nil, fmt.Errorf("reading bundle manifest: %w", err)
+		}
+		found = true
+		for _, entry := range manifest {
+			if len(entry.RepoTags) == 0 {
+				untagged = append(untagged, entry.Config)
+			}
+			for _, tag := range entry.RepoTags {
+				image, err := normalizeImage(tag)
+				if err != nil {
+					return nil, nil, err
+				}
+				images = append(images, image)
+			}
+		}
+	}
+	if !found {
+		return nil, nil, errors.New("bundle has no manifest.json, it is not a docker save tarball")
+	}
+	// drain the padding after the end of the archive
+	if _, err := io.Copy(ioutil.Discard, buf); err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(images)
+	return images, untagged, nil
+}
+
+// normalizeImage spells references the same way, so nginx and
+// docker.io/library/nginx:latest compare equal.
+func normalizeImage(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
+
+// ProjectImages lists the images of every service of the project,
+// normalized.
+func ProjectImages(project *ctypes.Project) ([]string, error) {
+	seen := map[string]bool{}
+	images := []string{}
+	for _, service := range project.AllServices() {
+		image, err := normalizeImage(service.Image)
+		if err != nil {
+			return nil, fmt.Errorf("service '%s': %w", service.Name, err)
+		}
+		if !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// CheckBundles verifies that the bundles only hold images the project
+// uses, so an upload cannot fill the engine with anything else. Untagged
+// images are refused, nothing tells what they are.
+func CheckBundles(project *ctypes.Project, bundles []*ImageBundle) error {
+	images, err := ProjectImages(project)
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, image := range images {
+		used[image] = true
+	}
+	for _, bundle := range bundles {
+		if len(bundle.Untagged) > 0 {
+			return fmt.Errorf("%w: %s", ErrUntaggedImage, strings.Join(bundle.Untagged, ", "))
+		}
+		for _, image := range bundle.Images {
+			if !used[image] {
+				return fmt.Errorf("%w: %s", ErrUnexpectedImage, image)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckBundleImage verifies that the bundle holds the image and nothing
+// else, as one rebuilt from a delta of the image must.
+func CheckBundleImage(bundle *ImageBundle, image string) error {
+	want, err := normalizeImage(image)
+	if err != nil {
+		return err
+	}
+	if len(bundle.Untagged) > 0 {
+		return fmt.Errorf("%w: %s", ErrUntaggedImage, strings.Join(bundle.Untagged, ", "))
+	}
+	if len(bundle.Images) != 1 || bundle.Images[0] != want {
+		return fmt.Errorf("%w: bundle holds %s, expected only %s", ErrUnexpectedImage, strings.Join(bundle.Images, ", "), want)
+	}
+	return nil
+}
+
+// LoadImageBundle loads the bundle into the engine.
+func LoadImageBundle(ctx context.Context, cli *client.Client, bundle *ImageBundle, progress Progress) error {
+	f, err := os.Open(bundle.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	loaded, err := cli.ImageLoad(ctx, f, true)
+	if err != nil {
+		return err
+	}
+	defer loaded.Body.Close()
+
+	dec := json.NewDecoder(loaded.Body)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if line := strings.TrimSpace(msg.Stream); line != "" {
+			progress.report("%s", line)
+		}
+	}
+}
+
+// MissingImages lists the images of the project the engine does not have.
+func MissingImages(ctx context.Context, cli *client.Client, project *ctypes.Project) ([]string, error) {
+	images, err := ProjectImages(project)
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	for _, image := range images {
+		_, _, err := cli.ImageInspectWithRaw(ctx, image)
+		if client.IsErrNotFound(err) {
+			missing = append(missing, image)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
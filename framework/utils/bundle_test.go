@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckBundleImage(t *testing.T) {
+	tests := []struct {
+		name   string
+		bundle ImageBundle
+		err    error
+	}{
+		{"the image", ImageBundle{Images: []string{"docker.io/library/nginx:1.21"}}, nil},
+		{"another image", ImageBundle{Images: []string{"docker.io/library/redis:latest"}}, ErrUnexpectedImage},
+		{"the image and another", ImageBundle{Images: []string{"docker.io/library/nginx:1.21", "docker.io/library/redis:latest"}}, ErrUnexpectedImage},
+		{"untagged image", ImageBundle{Images: []string{"docker.io/library/nginx:1.21"}, Untagged: []string{"abc.json"}}, ErrUntaggedImage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := CheckBundleImage(&test.bundle, "nginx:1.21"); !errors.Is(err, test.err) {
+				t.Errorf("error = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
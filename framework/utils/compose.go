@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 
 	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
@@ -38,20 +39,22 @@ const (
 	ContainerNotCreated ContainerStatus = iota
 )
 
+// AppContainerLink is one replica of a service, Replica numbered from 1,
+// and the container named Name if it exists.
 type AppContainerLink struct {
 	Service   ctypes.ServiceConfig
+	Replica   int
+	Name      string
 	Container *types.Container
 	Status    ContainerStatus
 }
 
-var hasher = sha256.New()
-
 func (link *AppContainerLink) CalculateServiceHash() (string, error) {
 	payload, err := json.Marshal(link.Service)
 	if err != nil {
 		return "", err
 	}
-	defer hasher.Reset()
+	hasher := sha256.New()
 	reader := strings.NewReader(string(payload))
 	if _, err := io.Copy(hasher, reader); err != nil {
 		return "", err
@@ -59,48 +62,102 @@ func (link *AppContainerLink) CalculateServiceHash() (string, error) {
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
+// AssociateContainerApp links every replica of every service of the app to
+// its container. The links are returned in dependency order, services
+// first, then by replica.
+//
+// Containers are matched by their ownership labels only. Containers
+// created before the labels existed are not seen until AdoptContainers
+// replaces them with labeled ones.
 func AssociateContainerApp(app app_registry.App, cli *client.Client) ([]AppContainerLink, error) {
 	project, err := compose.LoadDockerCompose([]byte(app.ComposeScript), app.Name)
 	if err != nil {
 		return nil, err
 	}
+	order, err := compose.ServiceStartOrder(project)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := cli.ContainerList(context.Background(), types.ContainerListOptions{
+		All:     true,
+		Filters: appContainerFilter(app.ID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	var conts []AppContainerLink
-	for _, service := range project.AllServices() {
-		cont, err := getContainerForAppService(fmt.Sprintf("/%s_%s", project.Name, service.Name), cli)
+	for _, name := range order {
+		service, err := project.GetService(name)
 		if err != nil {
 			return nil, err
 		}
-		status := ContainerNotCreated
-		if cont != nil {
-			if cont.State != "running" {
-				status = ContainerNotRunning
-			} else {
-				status = ContainerRunning
+		for i, contName := range compose.ReplicaNames(project.Name, service) {
+			link := AppContainerLink{
+				Service: service,
+				Replica: i + 1,
+				Name:    contName,
+				Status:  ContainerNotCreated,
+			}
+			link.Container = ownedContainer(owned, service.Name, link.Replica, contName)
+			if link.Container != nil {
+				if link.Container.State != "running" {
+					link.Status = ContainerNotRunning
+				} else {
+					link.Status = ContainerRunning
+				}
 			}
+			conts = append(conts, link)
 		}
-		conts = append(conts, AppContainerLink{
-			Service:   service,
-			Container: cont,
-			Status:    status,
-		})
 	}
 
 	return conts, nil
 }
 
-func getContainerForAppService(serviceName string, cli *client.Client) (*types.Container, error) {
-	conts, err := cli.ContainerList(context.Background(), types.ContainerListOptions{
-		All: true,
-		Filters: filters.NewArgs(filters.KeyValuePair{
-			Key:   "name",
-			Value: serviceName,
-		}),
+func appContainerFilter(appID uint) filters.Args {
+	return filters.NewArgs(filters.KeyValuePair{
+		Key:   "label",
+		Value: fmt.Sprintf("%s=%d", compose.LabelAppID, appID),
 	})
+}
+
+// replicaContainerIDs returns the IDs of the containers of the replicas of
+// a service of the app, found by their ownership labels and keyed by
+// replica name. Replicas without a container are left out.
+func replicaContainerIDs(ctx context.Context, cli *client.Client, appID uint, projectName string, service ctypes.ServiceConfig) (map[string]string, error) {
+	args := appContainerFilter(appID)
+	args.Add("label", fmt.Sprintf("%s=%s", compose.LabelService, service.Name))
+	owned, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
 	if err != nil {
 		return nil, err
 	}
-	if len(conts) == 0 {
-		return nil, nil
+	ids := map[string]string{}
+	for i, contName := range compose.ReplicaNames(projectName, service) {
+		if cont := ownedContainer(owned, service.Name, i+1, contName); cont != nil {
+			ids[contName] = cont.ID
+		}
+	}
+	return ids, nil
+}
+
+// ownedContainer picks the container of the replica among the containers of
+// the app. While a blue-green update runs two containers carry the same
+// labels, the one with the replica name is the one in service.
+func ownedContainer(owned []types.Container, service string, replica int, contName string) *types.Container {
+	var found *types.Container
+	for i := range owned {
+		cont := &owned[i]
+		if cont.Labels[compose.LabelService] != service || cont.Labels[compose.LabelReplica] != strconv.Itoa(replica) {
+			continue
+		}
+		for _, name := range cont.Names {
+			if name == "/"+contName {
+				return cont
+			}
+		}
+		if found == nil {
+			found = cont
+		}
 	}
-	return &conts[0], nil
+	return found
 }
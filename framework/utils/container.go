@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"context"
+	"strconv"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/client"
+)
+
+// Owner is the app revision containers are created for.
+type Owner struct {
+	AppID    uint
+	App      string
+	Revision uint
+}
+
+func AppOwner(app app_registry.App) Owner {
+	return Owner{AppID: app.ID, App: app.Name, Revision: app.Revision}
+}
+
+func CreateServiceContainer(ctx context.Context, cli *client.Client, owner Owner, project *ctypes.Project, service ctypes.ServiceConfig, replica int) (string, error) {
+	opts, err := serviceOptions(owner, project, service, replica)
+	if err != nil {
+		return "", err
+	}
+	return createContainer(ctx, cli, opts)
+}
+
+// serviceOptions are the container options of the replica, labeled with
+// its owner and with the hash of the service so drift can be detected
+// later.
+func serviceOptions(owner Owner, project *ctypes.Project, service ctypes.ServiceConfig, replica int) (*compose.ContainerOptions, error) {
+	opts, err := compose.ServiceContainerOptions(project, service, replica)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := ServiceHash(service)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Config.Labels == nil {
+		opts.Config.Labels = map[string]string{}
+	}
+	opts.Config.Labels[compose.LabelApp] = owner.App
+	opts.Config.Labels[compose.LabelAppID] = strconv.FormatUint(uint64(owner.AppID), 10)
+	opts.Config.Labels[compose.LabelService] = service.Name
+	opts.Config.Labels[compose.LabelReplica] = strconv.Itoa(replica)
+	opts.Config.Labels[compose.LabelRevision] = strconv.FormatUint(uint64(owner.Revision), 10)
+	opts.Config.Labels[compose.LabelServiceHash] = hash
+	return opts, nil
+}
+
+func createContainer(ctx context.Context, cli *client.Client, opts *compose.ContainerOptions) (string, error) {
+	body, err := cli.ContainerCreate(ctx, opts.Config, opts.HostConfig, opts.NetworkingConfig, nil, opts.Name)
+	if err != nil {
+		return "", err
+	}
+	for networkName, endpoint := range opts.ExtraNetworks {
+		err = cli.NetworkConnect(ctx, networkName, body.ID, endpoint)
+		if err != nil {
+			return body.ID, err
+		}
+	}
+	return body.ID, nil
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+var (
+	DependencyTimeout      = 5 * time.Minute
+	DependencyPollInterval = time.Second
+)
+
+// WaitForDependencies blocks until every dependency of the service meets the
+// condition declared in depends_on. Dependencies are expected to be started
+// already, which AssociateContainerApp's ordering guarantees. Their
+// containers are the ones labeled as the app's.
+func WaitForDependencies(ctx context.Context, cli *client.Client, appID uint, project *ctypes.Project, service ctypes.ServiceConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, DependencyTimeout)
+	defer cancel()
+
+	for dep, cfg := range service.DependsOn {
+		switch cfg.Condition {
+		case "", ctypes.ServiceConditionStarted:
+			continue
+		case ctypes.ServiceConditionHealthy, ctypes.ServiceConditionCompletedSuccessfully:
+		default:
+			return fmt.Errorf("service '%s' has unknown depends_on condition '%s'", service.Name, cfg.Condition)
+		}
+		depService, err := project.GetService(dep)
+		if err != nil {
+			return err
+		}
+		ids, err := replicaContainerIDs(ctx, cli, appID, project.Name, depService)
+		if err != nil {
+			return err
+		}
+		for _, contName := range compose.ReplicaNames(project.Name, depService) {
+			id, ok := ids[contName]
+			if !ok {
+				return fmt.Errorf("service '%s' waiting on '%s': container '%s' does not exist", service.Name, dep, contName)
+			}
+			err = waitForCondition(ctx, cli, contName, id, cfg.Condition)
+			if err != nil {
+				return fmt.Errorf("service '%s' waiting on '%s': %w", service.Name, dep, err)
+			}
+		}
+	}
+	return nil
+}
+
+func waitForCondition(ctx context.Context, cli *client.Client, contName string, id string, condition string) error {
+	ticker := time.NewTicker(DependencyPollInterval)
+	defer ticker.Stop()
+	for {
+		done, err := checkCondition(ctx, cli, contName, id, condition)
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkCondition(ctx context.Context, cli *client.Client, contName string, id string, condition string) (bool, error) {
+	cont, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	state := cont.State
+	switch condition {
+	case ctypes.ServiceConditionHealthy:
+		if state.Health == nil {
+			return false, fmt.Errorf("container '%s' has no healthcheck", contName)
+		}
+		switch state.Health.Status {
+		case types.Healthy:
+			return true, nil
+		case types.Unhealthy:
+			return false, fmt.Errorf("container '%s' is unhealthy", contName)
+		}
+		if !state.Running {
+			return false, fmt.Errorf("container '%s' is not running", contName)
+		}
+	case ctypes.ServiceConditionCompletedSuccessfully:
+		if state.Running || state.Status == "created" {
+			return false, nil
+		}
+		if state.ExitCode != 0 {
+			return false, fmt.Errorf("container '%s' exited with code %d", contName, state.ExitCode)
+		}
+		return true, nil
+	}
+	return false, nil
+}
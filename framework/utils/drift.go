@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+type DriftKind string
+
+const (
+	// DriftMissing is a container that does not exist.
+	DriftMissing DriftKind = "missing"
+	// DriftStopped is a container not running while the app should run.
+	DriftStopped DriftKind = "stopped"
+	// DriftRunning is a container running while the app is stopped.
+	DriftRunning DriftKind = "running"
+	// DriftModified is a container created from another version of its
+	// service than the registered one.
+	DriftModified DriftKind = "modified"
+	// DriftUnlabeled is a container without the service hash label, or a
+	// legacy container without any owner label, see LegacyContainers. It is
+	// only reported.
+	DriftUnlabeled DriftKind = "unlabeled"
+)
+
+// driftSeverity ranks the kinds of drift a container can have at once, a
+// container is reported with its most severe one. A modified container is
+// recreated, and so left running or stopped as the app is.
+var driftSeverity = map[DriftKind]int{
+	DriftUnlabeled: 1,
+	DriftRunning:   2,
+	DriftStopped:   3,
+	DriftModified:  4,
+	DriftMissing:   5,
+}
+
+type Drift struct {
+	Service   string    `json:"service"`
+	Replica   int       `json:"replica"`
+	Container string    `json:"container"`
+	Kind      DriftKind `json:"kind"`
+	Detail    string    `json:"detail,omitempty"`
+	// ID is the container found by its ownership labels, the one healed.
+	// Missing and legacy containers have none.
+	ID string `json:"id,omitempty"`
+}
+
+// DetectDrift compares the containers of the app with its registered
+// compose script and desired state. Drift is returned in dependency order,
+// at most one per container.
+func DetectDrift(ctx context.Context, cli *client.Client, app app_registry.App) ([]Drift, error) {
+	conts, err := AssociateContainerApp(app, cli)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, err := LegacyContainers(ctx, cli, app)
+	if err != nil {
+		return nil, err
+	}
+
+	drifts := []Drift{}
+	for _, cont := range conts {
+		drift := Drift{Service: cont.Service.Name, Replica: cont.Replica, Container: cont.Name}
+		if cont.Status == ContainerNotCreated {
+			if _, ok := legacy[cont.Name]; ok {
+				drift.Kind = DriftUnlabeled
+				drift.Detail = "created before ownership labels, adopt it first"
+				drifts = append(drifts, drift)
+			} else if !app.Stopped {
+				drift.Kind = DriftMissing
+				drifts = append(drifts, drift)
+			}
+			continue
+		}
+
+		drift.ID = cont.Container.ID
+		hash, err := ServiceHash(cont.Service)
+		if err != nil {
+			return nil, err
+		}
+		var found []Drift
+		switch label, ok := cont.Container.Labels[compose.LabelServiceHash]; {
+		case !ok:
+			found = append(found, Drift{Kind: DriftUnlabeled})
+		case label != hash:
+			found = append(found, Drift{
+				Kind:   DriftModified,
+				Detail: fmt.Sprintf("created from service hash %s, registered is %s", label, hash),
+			})
+		}
+
+		switch {
+		case app.Stopped && cont.Status == ContainerRunning:
+			found = append(found, Drift{Kind: DriftRunning})
+		case !app.Stopped && cont.Status == ContainerNotRunning:
+			done, err := completedOneShot(ctx, cli, cont)
+			if err != nil {
+				return nil, err
+			}
+			if !done {
+				found = append(found, Drift{Kind: DriftStopped, Detail: cont.Container.Status})
+			}
+		}
+		if len(found) > 0 {
+			worst := mostSevere(found)
+			drift.Kind = worst.Kind
+			drift.Detail = worst.Detail
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts, nil
+}
+
+// mostSevere returns the most severe of the drifts of a container, its
+// detail mentioning the other kinds.
+func mostSevere(found []Drift) Drift {
+	worst := found[0]
+	for _, d := range found[1:] {
+		if driftSeverity[d.Kind] > driftSeverity[worst.Kind] {
+			worst = d
+		}
+	}
+	var others []string
+	for _, d := range found {
+		if d.Kind != worst.Kind {
+			others = append(others, string(d.Kind))
+		}
+	}
+	if len(others) > 0 {
+		also := "also " + strings.Join(others, ", ")
+		if worst.Detail == "" {
+			worst.Detail = also
+		} else {
+			worst.Detail += "; " + also
+		}
+	}
+	return worst
+}
+
+// completedOneShot tells a service that ran to completion, exited with 0
+// and is not meant to be restarted, from one that stopped.
+func completedOneShot(ctx context.Context, cli *client.Client, cont AppContainerLink) (bool, error) {
+	inspect, err := cli.ContainerInspect(ctx, cont.Container.ID)
+	if err != nil {
+		return false, err
+	}
+	if inspect.State.Status != "exited" || inspect.State.ExitCode != 0 {
+		return false, nil
+	}
+	policy := inspect.HostConfig.RestartPolicy
+	return policy.IsNone() || policy.IsOnFailure(), nil
+}
+
+// Healable filters the drift the policy can fix.
+func Healable(drifts []Drift, policy app_registry.HealPolicy) []Drift {
+	healable := []Drift{}
+	for _, drift := range drifts {
+		switch drift.Kind {
+		case DriftMissing, DriftStopped, DriftRunning:
+			if policy == app_registry.HealRestart || policy == app_registry.HealRecreate {
+				healable = append(healable, drift)
+			}
+		case DriftModified:
+			if policy == app_registry.HealRecreate {
+				healable = append(healable, drift)
+			}
+		}
+	}
+	return healable
+}
+
+// HealDrift brings the drifted containers back to the registered state:
+// missing ones are created, modified ones recreated, and the others started
+// or stopped to match the app.
+func HealDrift(ctx context.Context, cli *client.Client, app app_registry.App, drifts []Drift, auth RegistryAuth, progress Progress) error {
+	if len(drifts) == 0 {
+		return nil
+	}
+	project, err := compose.LoadDockerCompose([]byte(app.ComposeScript), app.Name)
+	if err != nil {
+		return err
+	}
+	err = EnsureAppResources(ctx, cli, project)
+	if err != nil {
+		return err
+	}
+	var recreated []string
+	for _, drift := range drifts {
+		if drift.Kind == DriftMissing || drift.Kind == DriftModified {
+			recreated = append(recreated, drift.Service)
+		}
+	}
+	err = EnsureServiceImages(ctx, cli, project, recreated, auth, progress)
+	if err != nil {
+		return err
+	}
+
+	for _, drift := range drifts {
+		service, err := project.GetService(drift.Service)
+		if err != nil {
+			return err
+		}
+		switch drift.Kind {
+		case DriftRunning:
+			err = cli.ContainerStop(ctx, drift.ID, nil)
+		case DriftStopped:
+			err = WaitForDependencies(ctx, cli, app.ID, project, service)
+			if err == nil {
+				err = cli.ContainerStart(ctx, drift.ID, types.ContainerStartOptions{})
+			}
+		case DriftModified, DriftMissing:
+			if drift.Kind == DriftModified {
+				err = cli.ContainerRemove(ctx, drift.ID, types.ContainerRemoveOptions{Force: true})
+				if err != nil {
+					break
+				}
+			}
+			err = WaitForDependencies(ctx, cli, app.ID, project, service)
+			if err != nil {
+				break
+			}
+			var id string
+			id, err = CreateServiceContainer(ctx, cli, AppOwner(app), project, service, drift.Replica)
+			if err == nil && !app.Stopped {
+				err = cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
+			}
+		default:
+			err = fmt.Errorf("cannot heal %s drift", drift.Kind)
+		}
+		if err != nil {
+			return fmt.Errorf("healing %s %s: %w", drift.Kind, drift.Container, err)
+		}
+		progress.report("healed %s %s", drift.Kind, drift.Container)
+	}
+	return nil
+}
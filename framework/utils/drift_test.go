@@ -0,0 +1,39 @@
+package utils
+
+import "testing"
+
+func TestMostSevere(t *testing.T) {
+	tests := []struct {
+		name   string
+		found  []Drift
+		kind   DriftKind
+		detail string
+	}{
+		{
+			name:   "single",
+			found:  []Drift{{Kind: DriftStopped, Detail: "Exited (1)"}},
+			kind:   DriftStopped,
+			detail: "Exited (1)",
+		},
+		{
+			name:   "modified and stopped",
+			found:  []Drift{{Kind: DriftModified, Detail: "created from service hash a"}, {Kind: DriftStopped, Detail: "Exited (1)"}},
+			kind:   DriftModified,
+			detail: "created from service hash a; also stopped",
+		},
+		{
+			name:   "unlabeled and running",
+			found:  []Drift{{Kind: DriftUnlabeled}, {Kind: DriftRunning}},
+			kind:   DriftRunning,
+			detail: "also unlabeled",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			drift := mostSevere(test.found)
+			if drift.Kind != test.kind || drift.Detail != test.detail {
+				t.Errorf("drift = %s %q, want %s %q", drift.Kind, drift.Detail, test.kind, test.detail)
+			}
+		})
+	}
+}
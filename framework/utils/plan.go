@@ -0,0 +1,610 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+type PlanAction string
+
+const (
+	PlanStop   PlanAction = "stop"
+	PlanRemove PlanAction = "remove"
+	PlanCreate PlanAction = "create"
+	PlanStart  PlanAction = "start"
+	// PlanBlueGreen replaces the running container of a blue-green service,
+	// see BlueGreenReplace.
+	PlanBlueGreen PlanAction = "blue-green"
+)
+
+// PlanStep is an action on a service container. Replica is set for
+// services with several replicas, Batch for the steps of a rolling update.
+type PlanStep struct {
+	Action    PlanAction `json:"action"`
+	Service   string     `json:"service"`
+	Replica   int        `json:"replica,omitempty"`
+	Container string     `json:"container,omitempty"`
+	Batch     int        `json:"batch,omitempty"`
+}
+
+func (step PlanStep) String() string {
+	if step.Replica == 0 {
+		return fmt.Sprintf("%s %s", step.Action, step.Service)
+	}
+	return fmt.Sprintf("%s %s replica %d", step.Action, step.Service, step.Replica)
+}
+
+type ServiceRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+type ServiceChange struct {
+	Service string        `json:"service"`
+	Diff    []FieldChange `json:"diff"`
+}
+
+// ProjectDiff sorts the services of two versions of a compose project by
+// what happened to them, with a field-level diff for the changed ones.
+type ProjectDiff struct {
+	OldHash   string          `json:"oldHash"`
+	NewHash   string          `json:"newHash"`
+	Added     []string        `json:"added"`
+	Removed   []string        `json:"removed"`
+	Renamed   []ServiceRename `json:"renamed"`
+	Changed   []ServiceChange `json:"changed"`
+	Unchanged []string        `json:"unchanged"`
+}
+
+func (diff *ProjectDiff) HasChanges() bool {
+	return diff.OldHash != diff.NewHash
+}
+
+// UpdatePlan describes what an update would do to an app. It is computed
+// without touching any container, so it can be reviewed before being
+// applied with ApplyUpdatePlan.
+type UpdatePlan struct {
+	ID string `json:"id"`
+	ProjectDiff
+	Steps []PlanStep `json:"steps"`
+}
+
+// StartedServices lists the services the plan creates or starts, in order.
+func (plan *UpdatePlan) StartedServices() []string {
+	var services []string
+	seen := map[string]bool{}
+	for _, step := range plan.Steps {
+		if (step.Action == PlanStart || step.Action == PlanBlueGreen) && !seen[step.Service] {
+			seen[step.Service] = true
+			services = append(services, step.Service)
+		}
+	}
+	return services
+}
+
+func ServiceHash(service ctypes.ServiceConfig) (string, error) {
+	link := AppContainerLink{Service: service}
+	return link.CalculateServiceHash()
+}
+
+func ProjectHash(project *ctypes.Project) (string, error) {
+	payload, err := json.Marshal(project)
+	if err != nil {
+		return "", err
+	}
+	return app_registry.CalculateHash(payload)
+}
+
+func serviceHashes(project *ctypes.Project) ([]string, map[string]string, error) {
+	order, err := compose.ServiceStartOrder(project)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := map[string]string{}
+	for _, name := range order {
+		service, err := project.GetService(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[name], err = ServiceHash(service)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return order, hashes, nil
+}
+
+func DiffProjects(oldProject *ctypes.Project, newProject *ctypes.Project) (*ProjectDiff, error) {
+	diff := &ProjectDiff{
+		Added:     []string{},
+		Removed:   []string{},
+		Renamed:   []ServiceRename{},
+		Changed:   []ServiceChange{},
+		Unchanged: []string{},
+	}
+	var err error
+	diff.OldHash, err = ProjectHash(oldProject)
+	if err != nil {
+		return nil, err
+	}
+	diff.NewHash, err = ProjectHash(newProject)
+	if err != nil {
+		return nil, err
+	}
+
+	oldOrder, oldHashes, err := serviceHashes(oldProject)
+	if err != nil {
+		return nil, err
+	}
+	newOrder, newHashes, err := serviceHashes(newProject)
+	if err != nil {
+		return nil, err
+	}
+
+	renamedFrom := map[string]bool{}
+	for _, name := range newOrder {
+		oldHash, ok := oldHashes[name]
+		switch {
+		case !ok:
+			from := findRename(oldHashes, newHashes, renamedFrom, newHashes[name])
+			if from == "" {
+				diff.Added = append(diff.Added, name)
+				continue
+			}
+			renamedFrom[from] = true
+			diff.Renamed = append(diff.Renamed, ServiceRename{From: from, To: name})
+		case oldHash == newHashes[name]:
+			diff.Unchanged = append(diff.Unchanged, name)
+		default:
+			oldService, err := oldProject.GetService(name)
+			if err != nil {
+				return nil, err
+			}
+			newService, err := newProject.GetService(name)
+			if err != nil {
+				return nil, err
+			}
+			fields, err := serviceDiff(oldService, newService)
+			if err != nil {
+				return nil, err
+			}
+			diff.Changed = append(diff.Changed, ServiceChange{Service: name, Diff: fields})
+		}
+	}
+	for _, name := range oldOrder {
+		if _, ok := newHashes[name]; !ok && !renamedFrom[name] {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	return diff, nil
+}
+
+// NewUpdatePlan compares the old project, with its containers as returned by
+// AssociateContainerApp, against the new project.
+func NewUpdatePlan(oldProject *ctypes.Project, oldConts []AppContainerLink, newProject *ctypes.Project) (*UpdatePlan, error) {
+	diff, err := DiffProjects(oldProject, newProject)
+	if err != nil {
+		return nil, err
+	}
+	plan := &UpdatePlan{
+		ProjectDiff: *diff,
+		Steps:       []PlanStep{},
+	}
+	if plan.HasChanges() {
+		newOrder, err := compose.ServiceStartOrder(newProject)
+		if err != nil {
+			return nil, err
+		}
+		plan.Steps, err = updateSteps(plan, oldConts, newProject, newOrder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plan.ID, err = app_registry.CalculateHash(fmt.Sprintf("%s%s%v", plan.OldHash, plan.NewHash, plan.Steps))
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func findRename(oldHashes map[string]string, newHashes map[string]string, taken map[string]bool, hash string) string {
+	var candidates []string
+	for name, oldHash := range oldHashes {
+		if _, stillThere := newHashes[name]; stillThere || taken[name] {
+			continue
+		}
+		if oldHash == hash {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Strings(candidates)
+	return candidates[0]
+}
+
+// updateSteps only touches what the plan says differs: containers of
+// removed, renamed and changed services are stopped and removed, then the
+// services added, renamed or changed are created. Unchanged services keep
+// their container and are only started if they were not running, unless
+// they share the network namespace of or link to a recreated service.
+// Changed blue-green services that are running are replaced in place instead, and
+// changed services with several replicas are replaced batch by batch.
+func updateSteps(plan *UpdatePlan, oldConts []AppContainerLink, newProject *ctypes.Project, newOrder []string) ([]PlanStep, error) {
+	services := map[string]ctypes.ServiceConfig{}
+	for _, service := range newProject.AllServices() {
+		services[service.Name] = service
+	}
+
+	drop := map[string]bool{}
+	create := map[string]bool{}
+	for _, name := range plan.Removed {
+		drop[name] = true
+	}
+	for _, rename := range plan.Renamed {
+		drop[rename.From] = true
+		create[rename.To] = true
+	}
+	replace := map[string]bool{}
+	rolling := map[string]bool{}
+	for _, change := range plan.Changed {
+		service := services[change.Service]
+		cfg, err := compose.ServiceUpdateConfig(service)
+		if err != nil {
+			return nil, err
+		}
+		replace[change.Service] = cfg.Strategy == compose.StrategyBlueGreen
+		rolling[change.Service] = compose.ServiceReplicas(service) > 1
+		drop[change.Service] = true
+		create[change.Service] = true
+	}
+	for _, name := range plan.Added {
+		create[name] = true
+	}
+	// containers sharing the network namespace of a recreated container or
+	// linked to it still point at the old one, recreate them as well, in
+	// order so it carries on to their own dependents
+	added := map[string]bool{}
+	for _, name := range plan.Added {
+		added[name] = true
+	}
+	for _, name := range newOrder {
+		if !create[name] {
+			continue
+		}
+		for _, dependent := range compose.ServiceDependents(newProject, name) {
+			if !added[dependent] {
+				drop[dependent] = true
+				create[dependent] = true
+			}
+		}
+	}
+
+	steps := []PlanStep{}
+	oldByName := map[string][]AppContainerLink{}
+	for _, cont := range oldConts {
+		oldByName[cont.Service.Name] = append(oldByName[cont.Service.Name], cont)
+	}
+	for i := len(oldConts) - 1; i >= 0; i-- {
+		cont := oldConts[i]
+		name := cont.Service.Name
+		switch {
+		case replace[name] && cont.Status == ContainerRunning:
+			continue
+		case rolling[name] && cont.Replica <= compose.ServiceReplicas(services[name]):
+			continue
+		case !drop[name] || cont.Status == ContainerNotCreated:
+			continue
+		}
+		steps = append(steps, dropSteps(cont, 0)...)
+	}
+
+	for _, name := range newOrder {
+		service := services[name]
+		olds := oldByName[name]
+		replicas := compose.ServiceReplicas(service)
+		switch {
+		case replace[name] && len(olds) == 1 && olds[0].Status == ContainerRunning:
+			steps = append(steps, PlanStep{Action: PlanBlueGreen, Service: name, Container: olds[0].Container.ID})
+		case rolling[name]:
+			for i, batch := range compose.ServiceRollout(service).Batches(replicas) {
+				for _, r := range batch {
+					if r <= len(olds) {
+						steps = append(steps, dropSteps(olds[r-1], i+1)...)
+					}
+				}
+				for _, r := range batch {
+					steps = append(steps,
+						PlanStep{Action: PlanCreate, Service: name, Replica: r, Batch: i + 1},
+						PlanStep{Action: PlanStart, Service: name, Replica: r, Batch: i + 1},
+					)
+				}
+			}
+		default:
+			for r := 1; r <= replicas; r++ {
+				step := PlanStep{Service: name, Replica: stepReplica(service, r)}
+				if create[name] || r > len(olds) || olds[r-1].Status == ContainerNotCreated {
+					create := step
+					create.Action = PlanCreate
+					step.Action = PlanStart
+					steps = append(steps, create, step)
+				} else if olds[r-1].Status == ContainerNotRunning {
+					step.Action = PlanStart
+					step.Container = olds[r-1].Container.ID
+					steps = append(steps, step)
+				}
+			}
+		}
+	}
+	return steps, nil
+}
+
+// stepReplica is the replica a step refers to, 0 for services with a single
+// replica.
+func stepReplica(service ctypes.ServiceConfig, replica int) int {
+	if compose.ServiceReplicas(service) == 1 {
+		return 0
+	}
+	return replica
+}
+
+func dropSteps(cont AppContainerLink, batch int) []PlanStep {
+	if cont.Status == ContainerNotCreated {
+		return nil
+	}
+	step := PlanStep{
+		Service:   cont.Service.Name,
+		Replica:   stepReplica(cont.Service, cont.Replica),
+		Container: cont.Container.ID,
+		Batch:     batch,
+	}
+	var steps []PlanStep
+	if cont.Status == ContainerRunning {
+		stop := step
+		stop.Action = PlanStop
+		steps = append(steps, stop)
+	}
+	step.Action = PlanRemove
+	return append(steps, step)
+}
+
+func serviceDiff(oldService ctypes.ServiceConfig, newService ctypes.ServiceConfig) ([]FieldChange, error) {
+	oldFields, err := flattenService(oldService)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := flattenService(newService)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for k := range oldFields {
+		keys[k] = true
+	}
+	for k := range newFields {
+		keys[k] = true
+	}
+	var fields []string
+	for k := range keys {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+
+	diff := []FieldChange{}
+	for _, field := range fields {
+		if !reflect.DeepEqual(oldFields[field], newFields[field]) {
+			diff = append(diff, FieldChange{Field: field, Old: oldFields[field], New: newFields[field]})
+		}
+	}
+	return diff, nil
+}
+
+// flattenService turns a service into a map of dotted field paths, as they
+// appear in the compose file, to values. Lists are kept whole.
+func flattenService(service ctypes.ServiceConfig) (map[string]interface{}, error) {
+	payload, err := json.Marshal(service)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	if err := json.Unmarshal(payload, &tree); err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	flatten("", tree, fields)
+	return fields, nil
+}
+
+func flatten(prefix string, tree map[string]interface{}, fields map[string]interface{}) {
+	for k, v := range tree {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if sub, ok := v.(map[string]interface{}); ok && len(sub) > 0 {
+			flatten(key, sub, fields)
+			continue
+		}
+		fields[key] = v
+	}
+}
+
+// ApplyUpdatePlan runs the plan steps in order against the new project,
+// creating containers for owner.
+// Steps of a rolling update are run batch by batch: once a batch is
+// started its replicas are watched for the rollout monitor period, and the
+// next batch waits for the rollout delay. A replica failing does not stop
+// the update until more than the allowed ratio of replicas failed.
+func ApplyUpdatePlan(ctx context.Context, cli *client.Client, owner Owner, project *ctypes.Project, plan *UpdatePlan, progress Progress) error {
+	if len(plan.Steps) == 0 {
+		return nil
+	}
+	err := EnsureAppResources(ctx, cli, project)
+	if err != nil {
+		return err
+	}
+
+	created := map[string]string{}
+	var roll *rollout
+	for i, step := range plan.Steps {
+		if step.Batch == 0 {
+			err = applyStep(ctx, cli, owner, project, step, created, progress)
+			if err != nil {
+				return fmt.Errorf("%s: %w", step, err)
+			}
+			progress.report("%s", step)
+			continue
+		}
+
+		if roll == nil || roll.service.Name != step.Service {
+			service, err := project.GetService(step.Service)
+			if err != nil {
+				return err
+			}
+			roll = &rollout{
+				service: service,
+				cfg:     compose.ServiceRollout(service),
+				failed:  map[int]error{},
+				started: map[string]int{},
+				ids:     map[string]string{},
+			}
+		}
+		if roll.failed[step.Replica] == nil {
+			err = applyStep(ctx, cli, owner, project, step, created, progress)
+			if err != nil {
+				roll.fail(step.Replica, fmt.Errorf("%s: %w", step, err))
+				progress.report("%s failed: %s", step, err)
+			} else {
+				progress.report("%s", step)
+				if step.Action == PlanStart {
+					name := compose.ReplicaName(project.Name, roll.service, step.Replica)
+					roll.started[name] = step.Replica
+					roll.ids[name] = startedID(step, created)
+				}
+			}
+		}
+
+		next := PlanStep{}
+		if i+1 < len(plan.Steps) {
+			next = plan.Steps[i+1]
+		}
+		if next.Service != step.Service || next.Batch != step.Batch {
+			err = roll.finishBatch(ctx, cli, step.Batch, next.Service == step.Service, progress)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return PruneAppNetworks(ctx, cli, project.Name, project)
+}
+
+func applyStep(ctx context.Context, cli *client.Client, owner Owner, project *ctypes.Project, step PlanStep, created map[string]string, progress Progress) error {
+	key := fmt.Sprintf("%s/%d", step.Service, step.Replica)
+	switch step.Action {
+	case PlanStop:
+		return cli.ContainerStop(ctx, step.Container, nil)
+	case PlanRemove:
+		return cli.ContainerRemove(ctx, step.Container, types.ContainerRemoveOptions{})
+	case PlanCreate, PlanBlueGreen:
+		service, err := project.GetService(step.Service)
+		if err != nil {
+			return err
+		}
+		err = WaitForDependencies(ctx, cli, owner.AppID, project, service)
+		if err != nil {
+			return err
+		}
+		if step.Action == PlanBlueGreen {
+			return BlueGreenReplace(ctx, cli, owner, project, service, step.Container, progress)
+		}
+		replica := step.Replica
+		if replica == 0 {
+			replica = 1
+		}
+		created[key], err = CreateServiceContainer(ctx, cli, owner, project, service, replica)
+		return err
+	case PlanStart:
+		return cli.ContainerStart(ctx, startedID(step, created), types.ContainerStartOptions{})
+	}
+	return fmt.Errorf("unknown plan action '%s'", step.Action)
+}
+
+// startedID is the container a start step starts: the one of the plan, or
+// the one created by an earlier step.
+func startedID(step PlanStep, created map[string]string) string {
+	if step.Container != "" {
+		return step.Container
+	}
+	return created[fmt.Sprintf("%s/%d", step.Service, step.Replica)]
+}
+
+// rollout tracks the replicas of a service during a rolling update.
+type rollout struct {
+	service ctypes.ServiceConfig
+	cfg     compose.RolloutConfig
+	failed  map[int]error
+	last    error
+	started map[string]int
+	// ids are the containers started, by name
+	ids map[string]string
+}
+
+func (roll *rollout) fail(replica int, err error) {
+	roll.failed[replica] = err
+	roll.last = err
+}
+
+func (roll *rollout) finishBatch(ctx context.Context, cli *client.Client, batch int, more bool, progress Progress) error {
+	if roll.cfg.Monitor > 0 && len(roll.started) > 0 {
+		var names []string
+		for name := range roll.started {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		progress.report("monitoring batch %d of %s for %s", batch, roll.service.Name, roll.cfg.Monitor)
+		failed, err := watchContainers(ctx, cli, names, roll.ids, roll.cfg.Monitor, false)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if failed[name] != nil {
+				roll.fail(roll.started[name], failed[name])
+			}
+		}
+	}
+	roll.started = map[string]int{}
+
+	replicas := compose.ServiceReplicas(roll.service)
+	if float64(len(roll.failed)) > roll.cfg.MaxFailureRatio*float64(replicas) {
+		return fmt.Errorf("rolling update of %s: %d of %d replicas failed: %w", roll.service.Name, len(roll.failed), replicas, roll.last)
+	}
+	if !more || roll.cfg.Delay <= 0 {
+		return nil
+	}
+	progress.report("waiting %s before the next batch of %s", roll.cfg.Delay, roll.service.Name)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(roll.cfg.Delay):
+		return nil
+	}
+}
@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types"
+)
+
+func loadProject(t *testing.T, script string) *ctypes.Project {
+	t.Helper()
+	project, err := compose.LoadDockerCompose([]byte(script), "app")
+	if err != nil {
+		t.Fatalf("loading compose script: %s", err)
+	}
+	return project
+}
+
+// runningContainers links every replica of the project to a running
+// container, as AssociateContainerApp would once the app is started.
+func runningContainers(t *testing.T, project *ctypes.Project) []AppContainerLink {
+	t.Helper()
+	order, err := compose.ServiceStartOrder(project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conts []AppContainerLink
+	for _, name := range order {
+		service, err := project.GetService(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, contName := range compose.ReplicaNames(project.Name, service) {
+			conts = append(conts, AppContainerLink{
+				Service:   service,
+				Replica:   i + 1,
+				Name:      contName,
+				Container: &types.Container{ID: contName, State: "running"},
+				Status:    ContainerRunning,
+			})
+		}
+	}
+	return conts
+}
+
+func newPlan(t *testing.T, oldScript string, newScript string) *UpdatePlan {
+	t.Helper()
+	oldProject := loadProject(t, oldScript)
+	plan, err := NewUpdatePlan(oldProject, runningContainers(t, oldProject), loadProject(t, newScript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+// stepStrings spells the steps out, with their batch if they have one.
+func stepStrings(steps []PlanStep) []string {
+	out := []string{}
+	for _, step := range steps {
+		s := step.String()
+		if step.Batch > 0 {
+			s = fmt.Sprintf("%s batch %d", s, step.Batch)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+const planBase = `
+services:
+  db:
+    image: postgres:12
+  web:
+    image: nginx:1.20
+    depends_on: [db]
+`
+
+func TestUpdateSteps(t *testing.T) {
+	tests := []struct {
+		name      string
+		oldScript string
+		newScript string
+		steps     []string
+	}{
+		{
+			name:      "unchanged",
+			oldScript: planBase,
+			newScript: planBase,
+			steps:     []string{},
+		},
+		{
+			name:      "changed service only",
+			oldScript: planBase,
+			newScript: strings.Replace(planBase, "nginx:1.20", "nginx:1.21", 1),
+			steps:     []string{"stop web", "remove web", "create web", "start web"},
+		},
+		{
+			name:      "depends_on alone does not recreate dependents",
+			oldScript: planBase,
+			newScript: strings.Replace(planBase, "postgres:12", "postgres:13", 1),
+			steps:     []string{"stop db", "remove db", "create db", "start db"},
+		},
+		{
+			name:      "added service",
+			oldScript: planBase,
+			newScript: planBase + "  cache:\n    image: redis\n",
+			steps:     []string{"create cache", "start cache"},
+		},
+		{
+			name:      "removed service",
+			oldScript: planBase + "  cache:\n    image: redis\n",
+			newScript: planBase,
+			steps:     []string{"stop cache", "remove cache"},
+		},
+		{
+			name: "network_mode dependent",
+			oldScript: planBase + `  side:
+    image: busybox
+    network_mode: service:db
+`,
+			newScript: strings.Replace(planBase, "postgres:12", "postgres:13", 1) + `  side:
+    image: busybox
+    network_mode: service:db
+`,
+			steps: []string{
+				"stop side", "remove side", "stop db", "remove db",
+				"create db", "start db", "create side", "start side",
+			},
+		},
+		{
+			name: "links dependent and its own dependents",
+			oldScript: planBase + `  api:
+    image: api
+    links: [db]
+  side:
+    image: busybox
+    network_mode: service:api
+`,
+			newScript: strings.Replace(planBase, "postgres:12", "postgres:13", 1) + `  api:
+    image: api
+    links: [db]
+  side:
+    image: busybox
+    network_mode: service:api
+`,
+			steps: []string{
+				"stop side", "remove side", "stop api", "remove api", "stop db", "remove db",
+				"create db", "start db", "create api", "start api", "create side", "start side",
+			},
+		},
+		{
+			name: "scale up",
+			oldScript: `
+services:
+  web:
+    image: nginx
+    deploy:
+      replicas: 2
+`,
+			newScript: `
+services:
+  web:
+    image: nginx
+    deploy:
+      replicas: 3
+`,
+			steps: []string{
+				"stop web replica 1 batch 1", "remove web replica 1 batch 1",
+				"create web replica 1 batch 1", "start web replica 1 batch 1",
+				"stop web replica 2 batch 2", "remove web replica 2 batch 2",
+				"create web replica 2 batch 2", "start web replica 2 batch 2",
+				"create web replica 3 batch 3", "start web replica 3 batch 3",
+			},
+		},
+		{
+			name: "scale down",
+			oldScript: `
+services:
+  web:
+    image: nginx
+    deploy:
+      replicas: 3
+`,
+			newScript: `
+services:
+  web:
+    image: nginx
+    deploy:
+      replicas: 2
+`,
+			steps: []string{
+				"stop web replica 3", "remove web replica 3",
+				"stop web replica 1 batch 1", "remove web replica 1 batch 1",
+				"create web replica 1 batch 1", "start web replica 1 batch 1",
+				"stop web replica 2 batch 2", "remove web replica 2 batch 2",
+				"create web replica 2 batch 2", "start web replica 2 batch 2",
+			},
+		},
+		{
+			name: "update_config parallelism",
+			oldScript: `
+services:
+  web:
+    image: nginx:1.20
+    deploy:
+      replicas: 3
+      update_config:
+        parallelism: 2
+`,
+			newScript: `
+services:
+  web:
+    image: nginx:1.21
+    deploy:
+      replicas: 3
+      update_config:
+        parallelism: 2
+`,
+			steps: []string{
+				"stop web replica 1 batch 1", "remove web replica 1 batch 1",
+				"stop web replica 2 batch 1", "remove web replica 2 batch 1",
+				"create web replica 1 batch 1", "start web replica 1 batch 1",
+				"create web replica 2 batch 1", "start web replica 2 batch 1",
+				"stop web replica 3 batch 2", "remove web replica 3 batch 2",
+				"create web replica 3 batch 2", "start web replica 3 batch 2",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := newPlan(t, test.oldScript, test.newScript)
+			if steps := stepStrings(plan.Steps); !reflect.DeepEqual(steps, test.steps) {
+				t.Errorf("steps:\n  %s\nwant:\n  %s", strings.Join(steps, "\n  "), strings.Join(test.steps, "\n  "))
+			}
+		})
+	}
+}
+
+func TestUpdateStepsStartsStoppedContainers(t *testing.T) {
+	project := loadProject(t, planBase)
+	conts := runningContainers(t, project)
+	conts[0].Status = ContainerNotRunning
+	conts[1].Status = ContainerNotCreated
+	conts[1].Container = nil
+	newProject := loadProject(t, strings.Replace(planBase, "nginx:1.20", "nginx:1.21", 1))
+
+	plan, err := NewUpdatePlan(project, conts, newProject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"start db", "create web", "start web"}
+	if steps := stepStrings(plan.Steps); !reflect.DeepEqual(steps, want) {
+		t.Errorf("steps = %v, want %v", steps, want)
+	}
+}
+
+func TestUpdatePlanID(t *testing.T) {
+	newScript := strings.Replace(planBase, "nginx:1.20", "nginx:1.21", 1)
+	first := newPlan(t, planBase, newScript)
+	second := newPlan(t, planBase, newScript)
+	if first.ID == "" || first.ID != second.ID {
+		t.Errorf("plan IDs for the same inputs differ: %q and %q", first.ID, second.ID)
+	}
+	other := newPlan(t, planBase, strings.Replace(planBase, "nginx:1.20", "nginx:1.22", 1))
+	if other.ID == first.ID {
+		t.Error("plans for different scripts share an ID")
+	}
+	unchanged := newPlan(t, planBase, planBase)
+	if unchanged.ID == first.ID {
+		t.Error("an empty plan shares the ID of an update")
+	}
+}
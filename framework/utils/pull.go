@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"gorm.io/gorm"
+)
+
+var ErrImageMissing = errors.New("image is missing")
+
+// RegistryAuth returns the credentials to pull from a registry host, nil to
+// pull anonymously.
+type RegistryAuth func(host string) (*types.AuthConfig, error)
+
+// RegistryAuthFrom looks the credentials up in the app registry.
+func RegistryAuthFrom(reg *app_registry.AppRegistry) RegistryAuth {
+	return func(host string) (*types.AuthConfig, error) {
+		cred, err := reg.GetRegistryCredential(host)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &types.AuthConfig{
+			Username:      cred.Username,
+			Password:      cred.Password,
+			ServerAddress: cred.Registry,
+		}, nil
+	}
+}
+
+// EnsureServiceImages makes the images of the services available before
+// their containers are created, as their pull_policy says: always pulls
+// every time, missing (the default) only when the image is not here, and
+// never fails instead of pulling.
+func EnsureServiceImages(ctx context.Context, cli *client.Client, project *ctypes.Project, services []string, auth RegistryAuth, progress Progress) error {
+	pulled := map[string]bool{}
+	for _, name := range services {
+		service, err := project.GetService(name)
+		if err != nil {
+			return err
+		}
+		if pulled[service.Image] {
+			continue
+		}
+
+		present := true
+		_, _, err = cli.ImageInspectWithRaw(ctx, service.Image)
+		if client.IsErrNotFound(err) {
+			present = false
+		} else if err != nil {
+			return err
+		}
+
+		switch service.PullPolicy {
+		case ctypes.PullPolicyNever:
+			if !present {
+				return fmt.Errorf("%w: %s for service '%s', which is never pulled", ErrImageMissing, service.Image, service.Name)
+			}
+			continue
+		case "", ctypes.PullPolicyMissing, ctypes.PullPolicyIfNotPresent:
+			if present {
+				continue
+			}
+		}
+		err = PullImage(ctx, cli, service.Image, auth, progress)
+		if err != nil {
+			return fmt.Errorf("pulling %s for service '%s': %w", service.Image, service.Name, err)
+		}
+		pulled[service.Image] = true
+	}
+	return nil
+}
+
+// PullImage pulls the image with the credentials of its registry and
+// reports each layer once it is done.
+func PullImage(ctx context.Context, cli *client.Client, image string, auth RegistryAuth, progress Progress) error {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return err
+	}
+	opts := types.ImagePullOptions{}
+	if auth != nil {
+		cfg, err := auth(reference.Domain(named))
+		if err != nil {
+			return err
+		}
+		if cfg != nil {
+			payload, err := json.Marshal(cfg)
+			if err != nil {
+				return err
+			}
+			opts.RegistryAuth = base64.URLEncoding.EncodeToString(payload)
+		}
+	}
+
+	progress.report("pulling %s", image)
+	body, err := cli.ImagePull(ctx, reference.TagNameOnly(named).String(), opts)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case msg.Error != "":
+			return errors.New(msg.Error)
+		case msg.ID == "":
+			progress.report("%s", msg.Status)
+		case msg.Status == "Pull complete" || msg.Status == "Already exists":
+			progress.report("%s: %s", msg.ID, msg.Status)
+		}
+	}
+}
+
+// PullPlanImages gets the images of every service the plan creates, so an
+// update fails on a missing image before anything is stopped.
+func PullPlanImages(ctx context.Context, cli *client.Client, project *ctypes.Project, plan *UpdatePlan, auth RegistryAuth, progress Progress) error {
+	var services []string
+	seen := map[string]bool{}
+	for _, step := range plan.Steps {
+		if (step.Action == PlanCreate || step.Action == PlanBlueGreen) && !seen[step.Service] {
+			seen[step.Service] = true
+			services = append(services, step.Service)
+		}
+	}
+	return EnsureServiceImages(ctx, cli, project, services, auth, progress)
+}
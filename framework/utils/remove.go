@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	app_registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+type RemoveOptions struct {
+	Networks bool
+	Volumes  bool
+	Images   bool
+}
+
+// RemoveApp stops and removes every container of the app, in reverse
+// dependency order, including the ones left behind by an interrupted
+// update. Networks, volumes and images follow as asked. Images still used
+// by another container are kept.
+func RemoveApp(ctx context.Context, cli *client.Client, app app_registry.App, opts RemoveOptions, progress Progress) error {
+	project, err := compose.LoadDockerCompose([]byte(app.ComposeScript), app.Name)
+	if err != nil {
+		return err
+	}
+	conts, err := AssociateContainerApp(app, cli)
+	if err != nil {
+		return err
+	}
+
+	removed := map[string]bool{}
+	for i := len(conts) - 1; i >= 0; i-- {
+		cont := conts[i]
+		if cont.Status == ContainerNotCreated {
+			continue
+		}
+		if cont.Status == ContainerRunning {
+			err = cli.ContainerStop(ctx, cont.Container.ID, nil)
+			if err != nil {
+				return err
+			}
+			progress.report("stopped %s", cont.Name)
+		}
+		err = cli.ContainerRemove(ctx, cont.Container.ID, types.ContainerRemoveOptions{})
+		if err != nil {
+			return err
+		}
+		removed[cont.Container.ID] = true
+		progress.report("removed %s", cont.Name)
+	}
+
+	leftovers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: appContainerFilter(app.ID)})
+	if err != nil {
+		return err
+	}
+	for _, cont := range leftovers {
+		if removed[cont.ID] {
+			continue
+		}
+		err = cli.ContainerRemove(ctx, cont.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			return err
+		}
+		progress.report("removed leftover container %s", cont.Names)
+	}
+
+	if opts.Networks {
+		err = PruneAppNetworks(ctx, cli, project.Name, nil)
+		if err != nil {
+			return err
+		}
+		progress.report("removed networks")
+	}
+	if opts.Volumes {
+		err = RemoveAppVolumes(ctx, cli, project.Name)
+		if err != nil {
+			return err
+		}
+		progress.report("removed volumes")
+	}
+	if opts.Images {
+		seen := map[string]bool{}
+		for _, service := range project.AllServices() {
+			if seen[service.Image] {
+				continue
+			}
+			seen[service.Image] = true
+			_, err = cli.ImageRemove(ctx, service.Image, types.ImageRemoveOptions{PruneChildren: true})
+			switch {
+			case errdefs.IsConflict(err):
+				progress.report("kept image %s, still in use", service.Image)
+			case errdefs.IsNotFound(err):
+			case err != nil:
+				return fmt.Errorf("removing image %s: %w", service.Image, err)
+			default:
+				progress.report("removed image %s", service.Image)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// Resource rules for the networks and named volumes of an app:
+//   - start and update create whatever the compose project declares and is
+//     missing, labelled as owned by the app;
+//   - stop leaves networks and volumes in place;
+//   - update removes owned networks the new project no longer declares, but
+//     keeps volumes so data survives a service being renamed or dropped;
+//   - delete removes owned networks, and owned volumes only when asked to.
+// External networks and volumes are never created nor removed, only checked.
+
+func ownerFilter(projectName string) filters.Args {
+	return filters.NewArgs(filters.KeyValuePair{
+		Key:   "label",
+		Value: fmt.Sprintf("%s=%s", compose.LabelApp, projectName),
+	})
+}
+
+func resourceLabels(projectName string, kind string, key string, labels ctypes.Labels) map[string]string {
+	out := map[string]string{}
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[compose.LabelApp] = projectName
+	out[kind] = key
+	return out
+}
+
+func EnsureAppResources(ctx context.Context, cli *client.Client, project *ctypes.Project) error {
+	if err := ensureAppNetworks(ctx, cli, project); err != nil {
+		return err
+	}
+	return ensureAppVolumes(ctx, cli, project)
+}
+
+func ensureAppNetworks(ctx context.Context, cli *client.Client, project *ctypes.Project) error {
+	for key, net := range project.Networks {
+		existing, err := cli.NetworkInspect(ctx, net.Name, types.NetworkInspectOptions{})
+		if err == nil {
+			if !net.External.External && existing.Labels[compose.LabelApp] != project.Name {
+				return fmt.Errorf("network '%s' already exists and is not owned by app '%s'", net.Name, project.Name)
+			}
+			continue
+		}
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+		if net.External.External {
+			return fmt.Errorf("external network '%s' not found", net.Name)
+		}
+
+		var ipam *network.IPAM
+		if net.Ipam.Driver != "" || len(net.Ipam.Config) > 0 {
+			ipam = &network.IPAM{Driver: net.Ipam.Driver}
+			for _, pool := range net.Ipam.Config {
+				ipam.Config = append(ipam.Config, network.IPAMConfig{
+					Subnet:     pool.Subnet,
+					Gateway:    pool.Gateway,
+					IPRange:    pool.IPRange,
+					AuxAddress: pool.AuxiliaryAddresses,
+				})
+			}
+		}
+		_, err = cli.NetworkCreate(ctx, net.Name, types.NetworkCreate{
+			CheckDuplicate: true,
+			Driver:         net.Driver,
+			Options:        net.DriverOpts,
+			IPAM:           ipam,
+			Internal:       net.Internal,
+			Attachable:     net.Attachable,
+			Labels:         resourceLabels(project.Name, compose.LabelNetwork, key, net.Labels),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureAppVolumes(ctx context.Context, cli *client.Client, project *ctypes.Project) error {
+	for key, volume := range project.Volumes {
+		existing, err := cli.VolumeInspect(ctx, volume.Name)
+		if err == nil {
+			if !volume.External.External && existing.Labels[compose.LabelApp] != project.Name {
+				return fmt.Errorf("volume '%s' already exists and is not owned by app '%s'", volume.Name, project.Name)
+			}
+			continue
+		}
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+		if volume.External.External {
+			return fmt.Errorf("external volume '%s' not found", volume.Name)
+		}
+
+		_, err = cli.VolumeCreate(ctx, volumetypes.VolumeCreateBody{
+			Name:       volume.Name,
+			Driver:     volume.Driver,
+			DriverOpts: volume.DriverOpts,
+			Labels:     resourceLabels(project.Name, compose.LabelVolume, key, volume.Labels),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneAppNetworks removes the networks owned by the app that the project
+// no longer declares. Pass a nil project to remove every owned network.
+func PruneAppNetworks(ctx context.Context, cli *client.Client, projectName string, project *ctypes.Project) error {
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{Filters: ownerFilter(projectName)})
+	if err != nil {
+		return err
+	}
+	declared := map[string]bool{}
+	if project != nil {
+		for _, net := range project.Networks {
+			declared[net.Name] = true
+		}
+	}
+	for _, net := range networks {
+		if declared[net.Name] {
+			continue
+		}
+		err = cli.NetworkRemove(ctx, net.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveAppVolumes removes every volume owned by the app. It is only meant
+// for app deletion, volumes are otherwise retained.
+func RemoveAppVolumes(ctx context.Context, cli *client.Client, projectName string) error {
+	volumes, err := cli.VolumeList(ctx, ownerFilter(projectName))
+	if err != nil {
+		return err
+	}
+	for _, volume := range volumes.Volumes {
+		err = cli.VolumeRemove(ctx, volume.Name, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
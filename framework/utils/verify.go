@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	compose "github.com/beowulf20/docker-delta-update-server/framework/compose"
+	ctypes "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+var ErrVerificationFailed = errors.New("service failed verification")
+
+var (
+	DefaultVerifyWindow = 30 * time.Second
+	VerifyPollInterval  = time.Second
+)
+
+// VerifyServices watches the containers of the services of the app for the
+// whole window and fails as soon as one reports unhealthy, restarts or
+// exits with a non-zero code. Exiting with 0 is accepted for one-shot
+// services.
+func VerifyServices(ctx context.Context, cli *client.Client, appID uint, project *ctypes.Project, services []string, window time.Duration, progress Progress) error {
+	if window <= 0 || len(services) == 0 {
+		return nil
+	}
+	var names []string
+	ids := map[string]string{}
+	for _, name := range services {
+		service, err := project.GetService(name)
+		if err != nil {
+			return err
+		}
+		serviceIDs, err := replicaContainerIDs(ctx, cli, appID, project.Name, service)
+		if err != nil {
+			return err
+		}
+		for _, contName := range compose.ReplicaNames(project.Name, service) {
+			if _, ok := serviceIDs[contName]; !ok {
+				return fmt.Errorf("%w: %s does not exist", ErrVerificationFailed, contName)
+			}
+			ids[contName] = serviceIDs[contName]
+			names = append(names, contName)
+		}
+	}
+	progress.report("verifying %v for %s", services, window)
+
+	failed, err := watchContainers(ctx, cli, names, ids, window, true)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if failed[name] != nil {
+			return failed[name]
+		}
+	}
+	progress.report("verified %v", services)
+	return nil
+}
+
+// watchContainers checks the containers, named by names and found by ids,
+// for the whole window and returns why each failing one failed. With
+// failFast it returns on the first failure instead.
+func watchContainers(ctx context.Context, cli *client.Client, names []string, ids map[string]string, window time.Duration, failFast bool) (map[string]error, error) {
+	restarts := map[string]int{}
+	for _, name := range names {
+		cont, err := cli.ContainerInspect(ctx, ids[name])
+		if err != nil {
+			return nil, err
+		}
+		restarts[name] = cont.RestartCount
+	}
+
+	failed := map[string]error{}
+	ticker := time.NewTicker(VerifyPollInterval)
+	defer ticker.Stop()
+	deadline := time.After(window)
+	for {
+		for _, name := range names {
+			if failed[name] != nil {
+				continue
+			}
+			cont, err := cli.ContainerInspect(ctx, ids[name])
+			if err != nil {
+				return nil, err
+			}
+			if err := checkVerified(name, cont, restarts[name]); err != nil {
+				failed[name] = err
+				if failFast {
+					return failed, nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			return failed, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkVerified(name string, cont types.ContainerJSON, restarts int) error {
+	state := cont.State
+	switch {
+	case state.Health != nil && state.Health.Status == types.Unhealthy:
+		return fmt.Errorf("%w: %s is unhealthy", ErrVerificationFailed, name)
+	case state.Restarting || cont.RestartCount > restarts:
+		return fmt.Errorf("%w: %s is restarting", ErrVerificationFailed, name)
+	case !state.Running && state.ExitCode != 0:
+		return fmt.Errorf("%w: %s exited with code %d", ErrVerificationFailed, name, state.ExitCode)
+	}
+	return nil
+}
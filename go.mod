@@ -3,15 +3,18 @@ module github.com/beowulf20/docker-delta-update-server
 go 1.16
 
 require (
-	github.com/balena-os/librsync-go v0.5.0 // indirect
-	github.com/compose-spec/compose-go v0.0.0-20210722130045-6e1e1c2b26de // indirect
+	github.com/balena-os/librsync-go v0.5.0
+	github.com/compose-spec/compose-go v0.0.0-20210722130045-6e1e1c2b26de
 	github.com/containerd/containerd v1.5.4 // indirect
-	github.com/docker/docker v20.10.7+incompatible // indirect
-	github.com/docker/go-connections v0.4.0 // indirect
-	github.com/gin-gonic/gin v1.7.2 // indirect
+	github.com/docker/distribution v2.7.1+incompatible
+	github.com/docker/docker v20.10.7+incompatible
+	github.com/docker/go-connections v0.4.0
+	github.com/docker/go-units v0.4.0
+	github.com/gin-gonic/gin v1.7.2
 	github.com/go-ozzo/ozzo-validation v3.6.0+incompatible // indirect
-	github.com/go-ozzo/ozzo-validation/v4 v4.3.0 // indirect
-	github.com/go-playground/validator/v10 v10.8.0 // indirect
+	github.com/go-ozzo/ozzo-validation/v4 v4.3.0
+	github.com/go-playground/validator/v10 v10.8.0
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/json-iterator/go v1.1.11 // indirect
 	github.com/mattn/go-isatty v0.0.13 // indirect
@@ -21,7 +24,8 @@ require (
 	google.golang.org/grpc v1.39.0 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/asaskevich/govalidator.v9 v9.0.0-20180315120708-ccb8e960c48f // indirect
-	gorm.io/driver/mysql v1.1.1 // indirect
-	gorm.io/driver/sqlite v1.1.4 // indirect
-	gorm.io/gorm v1.21.12 // indirect
+	gopkg.in/yaml.v2 v2.4.0
+	gorm.io/driver/mysql v1.1.1
+	gorm.io/driver/sqlite v1.1.4
+	gorm.io/gorm v1.21.12
 )
@@ -1,12 +1,28 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	registry "github.com/beowulf20/docker-delta-update-server/framework/app-registry"
+	"github.com/beowulf20/docker-delta-update-server/framework/config"
+	"github.com/beowulf20/docker-delta-update-server/framework/logging"
 	framework_rest "github.com/beowulf20/docker-delta-update-server/framework/rest"
+	"github.com/beowulf20/docker-delta-update-server/framework/signing"
 	"github.com/docker/docker/client"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func fatalOnError(err error) {
@@ -15,55 +31,204 @@ func fatalOnError(err error) {
 	}
 }
 
-func main() {
-	reg, err := registry.NewAppRegistry()
-	fatalOnError(err)
-
-	composeFile, err := ioutil.ReadFile("/home/master/documents/personal/docker-diff-deploy-server/build/docker-compose.yml")
-	fatalOnError(err)
+// dockerClient connects to the engine of the DOCKER_* environment variables,
+// with what the configuration sets instead.
+func dockerClient(cfg config.DockerConfig) (*client.Client, error) {
+	opts := []client.Opt{client.FromEnv}
+	if cfg.TLSVerify {
+		opts = append(opts, client.WithTLSClientConfig(
+			filepath.Join(cfg.CertPath, "ca.pem"),
+			filepath.Join(cfg.CertPath, "cert.pem"),
+			filepath.Join(cfg.CertPath, "key.pem"),
+		))
+	}
+	if cfg.Host != "" {
+		opts = append(opts, client.WithHost(cfg.Host))
+	}
+	if cfg.APIVersion != "" {
+		opts = append(opts, client.WithVersion(cfg.APIVersion))
+	} else {
+		// a version from DOCKER_API_VERSION is kept
+		opts = append(opts, client.WithAPIVersionNegotiation())
+	}
+	return client.NewClientWithOpts(opts...)
+}
 
-	app, err := registry.NewApp("app_test_influx", string(composeFile))
-	fatalOnError(err)
-	fatalOnError(reg.AddApp(app))
+// upstreamClients builds the HTTP client of every upstream, with its own
+// certificates and timeout.
+func upstreamClients(upstreams []config.UpstreamConfig) (map[string]framework_rest.Upstream, error) {
+	clients := map[string]framework_rest.Upstream{}
+	for _, upstream := range upstreams {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if upstream.CA != "" {
+			pem, err := ioutil.ReadFile(upstream.CA)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("upstream '%s': no certificate in %s", upstream.Name, upstream.CA)
+			}
+		}
+		if upstream.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(upstream.Cert, upstream.Key)
+			if err != nil {
+				return nil, fmt.Errorf("upstream '%s': %w", upstream.Name, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		timeout := time.Duration(upstream.Timeout)
+		if timeout == 0 {
+			timeout = config.DefaultUpstreamTimeout
+		}
+		clients[upstream.Name] = framework_rest.Upstream{
+			URL: upstream.URL,
+			Client: &http.Client{
+				Transport: transport,
+				Timeout:   timeout,
+				// the API never redirects, following one could lead
+				// anywhere
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			},
+		}
+	}
+	return clients, nil
+}
 
-	cli, err := client.NewClientWithOpts()
-	fatalOnError(err)
+// registryLogger logs the database errors, and at the debug level the
+// queries too.
+func registryLogger(level string) logger.Interface {
+	l := logger.Warn
+	switch level {
+	case "debug":
+		l = logger.Info
+	case "error":
+		l = logger.Error
+	}
+	return logger.New(log.New(os.Stderr, "\r\n", log.LstdFlags), logger.Config{
+		SlowThreshold: 200 * time.Millisecond,
+		LogLevel:      l,
+		Colorful:      false,
+	})
+}
 
-	
+// bootstrapApps registers the apps of the configuration that are not yet.
+// When keys are trusted each compose file must come with its signature, as
+// the X-Signature header would carry it, in a file of the same name ending
+// in .sig.
+func bootstrapApps(reg *registry.AppRegistry, apps []config.BootstrapApp, keys *signing.KeyRing) error {
+	for _, bootstrap := range apps {
+		_, err := reg.GetAppByName(bootstrap.Name)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		composeFile, err := ioutil.ReadFile(bootstrap.ComposeFile)
+		if err != nil {
+			return err
+		}
+		info := registry.RevisionInfo{Message: "bootstrap"}
+		if keys.Required() {
+			sigFile := bootstrap.ComposeFile + ".sig"
+			sig, err := ioutil.ReadFile(sigFile)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			info.SignedBy, err = keys.Verify(signing.Digest(composeFile), strings.TrimSpace(string(sig)))
+			if err != nil {
+				return fmt.Errorf("bootstrap app '%s': %s: %w", bootstrap.Name, sigFile, err)
+			}
+		}
+		app, err := registry.NewApp(bootstrap.Name, string(composeFile))
+		if err != nil {
+			return fmt.Errorf("bootstrap app '%s': %w", bootstrap.Name, err)
+		}
+		if err := reg.AddApp(app, info); err != nil {
+			return fmt.Errorf("bootstrap app '%s': %w", bootstrap.Name, err)
+		}
+		logging.Infof("registered bootstrap app '%s' from %s", bootstrap.Name, bootstrap.ComposeFile)
+	}
+	return nil
+}
 
-	// appReplicas, err := reg.ListApps()
-	// fatalOnError(err)
+func main() {
+	cfg, print, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if print {
+		out, err := cfg.YAML()
+		fatalOnError(err)
+		os.Stdout.Write(out)
+		return
+	}
 
-	// for _, appReplica := range appReplicas {
-	// 	conts, err := utils.AssociateContainerApp(appReplica, cli)
-	// 	fatalOnError(err)
-	// 	for _, cont := range conts {
-	// 		if cont.Container == nil {
-	// 			// create container
-	// 			cli.ContainerCreate(context.Background(), &container.Config{
-	// 				Image: cont.Service.Image,
-	// 			}, nil, nil, nil, appReplica.Name+"_"+cont.Service.Name)
-	// 		} else {
-	// 			cli.ContainerStart(context.Background(), cont.Container.ID, types.ContainerStartOptions{})
-	// 		}
+	// validated by Load
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(level)
+	if level != logging.LevelDebug {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	opts := framework_rest.Options{
+		Addr:              cfg.Listen,
+		Workers:           cfg.Jobs.Workers,
+		RetainJobs:        cfg.Jobs.Retain,
+		LockLease:         time.Duration(cfg.Jobs.LockLease),
+		ReconcileInterval: time.Duration(cfg.Reconciler.Interval),
+		AccessLog:         logging.Enabled(logging.LevelInfo),
+	}
+	if cfg.TLS.Enabled() {
+		opts.TLS = &framework_rest.TLSOptions{
+			CertFile:          cfg.TLS.Cert,
+			KeyFile:           cfg.TLS.Key,
+			ClientCAFile:      cfg.TLS.ClientCA,
+			RequireClientCert: cfg.TLS.RequireClientCert,
+			SelfSigned:        cfg.TLS.SelfSigned,
+			Hosts:             cfg.TLS.Hosts,
+		}
+	}
+	opts.Upstreams, err = upstreamClients(cfg.Upstreams)
+	fatalOnError(err)
+	if cfg.Signing.TrustedKeys != "" {
+		keys, err := signing.LoadKeyRing(cfg.Signing.TrustedKeys)
+		fatalOnError(err)
+		opts.TrustedKeys = keys
+	}
+	if cfg.Signing.Key != "" {
+		signer, err := signing.LoadSigner(cfg.Signing.Key)
+		fatalOnError(err)
+		opts.Signer = signer
+	}
 
-	// 	}
-	// }
+	reg, err := registry.NewAppRegistryWithLogger(cfg.Database.Driver, cfg.Database.DSN, registryLogger(cfg.LogLevel))
+	fatalOnError(err)
 
-	fatalOnError(framework_rest.NewRestServer(reg, cli))
+	secretKey, err := registry.LoadSecretKey(cfg.SecretKey)
+	fatalOnError(err)
+	fatalOnError(reg.SetSecretKey(secretKey))
 
-	// time.Sleep(time.Second * 2)
+	// the secret of the first token is only ever shown here, whatever the
+	// log level
+	secret, err := reg.BootstrapToken()
+	fatalOnError(err)
+	if secret != "" {
+		log.Printf("created admin token 'bootstrap', keep it safe: %s", secret)
+	}
 
-	// var errs []error
-	// for _, appReplica := range appReplicas {
-	// 	err = StopContainers(context.Background(), appReplica, cli)
-	// 	if err != nil {
-	// 		errs = append(errs, err)
-	// 	}
-	// }
+	fatalOnError(bootstrapApps(reg, cfg.Bootstrap, opts.TrustedKeys))
 
-	// if len(errs) > 0 {
-	// 	log.Fatal(errs)
-	// }
+	cli, err := dockerClient(cfg.Docker)
+	fatalOnError(err)
 
+	fatalOnError(framework_rest.NewRestServer(reg, cli, opts))
 }